@@ -0,0 +1,233 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/ipv6"
+)
+
+// PacketConnBind implements Bind on top of any net.PacketConn, such as a
+// unix datagram socket, an in-process pipe or a QUIC datagram stream. If the
+// net.PacketConn also has ReadBatch and WriteBatch methods, like those of
+// ipv4.PacketConn and ipv6.PacketConn, they are used to move several
+// datagrams at a time.
+type PacketConnBind struct {
+	listen func(port uint16) (net.PacketConn, error)
+
+	mu   sync.Mutex // protects conn
+	conn net.PacketConn
+
+	msgsPool sync.Pool
+}
+
+// PacketConnEndpoint is an Endpoint for PacketConnBind, holding the remote
+// net.Addr.
+type PacketConnEndpoint struct {
+	Addr net.Addr
+}
+
+var (
+	_ Bind     = (*PacketConnBind)(nil)
+	_ Endpoint = (*PacketConnEndpoint)(nil)
+)
+
+// NewPacketConnBind returns a Bind that calls listen in Open to obtain the
+// net.PacketConn it sends and receives on. The Bind closes the
+// net.PacketConn in Close.
+func NewPacketConnBind(listen func(port uint16) (net.PacketConn, error)) Bind {
+	return &PacketConnBind{
+		listen: listen,
+		msgsPool: sync.Pool{
+			New: func() any {
+				msgs := make([]ipv6.Message, IdealBatchSize)
+				for i := range msgs {
+					msgs[i].Buffers = make(net.Buffers, 1)
+				}
+				return &msgs
+			},
+		},
+	}
+}
+
+func (e *PacketConnEndpoint) ClearSrc() {}
+
+func (e *PacketConnEndpoint) SrcToString() string { return "" }
+
+func (e *PacketConnEndpoint) DstToString() string { return e.Addr.String() }
+
+func (e *PacketConnEndpoint) DstToBytes() []byte {
+	if addrPort, ok := addrPortOf(e.Addr); ok {
+		b, _ := addrPort.MarshalBinary()
+		return b
+	}
+	return []byte(e.Addr.String())
+}
+
+func (e *PacketConnEndpoint) DstIP() netip.Addr {
+	addrPort, _ := addrPortOf(e.Addr)
+	return addrPort.Addr()
+}
+
+func (e *PacketConnEndpoint) SrcIP() netip.Addr { return netip.Addr{} }
+
+func addrPortOf(addr net.Addr) (netip.AddrPort, bool) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.AddrPort(), true
+	case *net.TCPAddr:
+		return addr.AddrPort(), true
+	}
+	return netip.AddrPort{}, false
+}
+
+// ParseEndpoint accepts an IP address and port, which becomes a
+// *net.UDPAddr, or an absolute or abstract unix socket path, which becomes a
+// *net.UnixAddr of type unixgram.
+func (b *PacketConnBind) ParseEndpoint(s string) (Endpoint, error) {
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, "@") {
+		return &PacketConnEndpoint{Addr: &net.UnixAddr{Name: s, Net: "unixgram"}}, nil
+	}
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketConnEndpoint{Addr: net.UDPAddrFromAddrPort(addrPort)}, nil
+}
+
+func (b *PacketConnBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	conn, err := b.listen(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	if addrPort, ok := addrPortOf(conn.LocalAddr()); ok {
+		port = addrPort.Port()
+	}
+	b.conn = conn
+	return []ReceiveFunc{b.makeReceiveFunc(conn)}, port, nil
+}
+
+func (b *PacketConnBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+func (b *PacketConnBind) SetMark(mark uint32) error { return nil }
+
+func (b *PacketConnBind) BatchSize() int { return IdealBatchSize }
+
+func (b *PacketConnBind) makeReceiveFunc(conn net.PacketConn) ReceiveFunc {
+	br, batched := conn.(batchReader)
+	return func(bufs [][]byte, sizes []int, eps []Endpoint) (n int, err error) {
+		if batched {
+			n, err = b.receiveBatch(br, bufs, sizes, eps)
+		} else {
+			var addr net.Addr
+			sizes[0], addr, err = conn.ReadFrom(bufs[0])
+			if err == nil {
+				eps[0] = &PacketConnEndpoint{Addr: addr}
+				n = 1
+			}
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) && b.isClosed(conn) {
+			// Not every net.PacketConn reports net.ErrClosed after being
+			// closed, but callers rely on it to know when to stop.
+			err = net.ErrClosed
+		}
+		return n, err
+	}
+}
+
+func (b *PacketConnBind) receiveBatch(br batchReader, bufs [][]byte, sizes []int, eps []Endpoint) (int, error) {
+	msgs := b.msgsPool.Get().(*[]ipv6.Message)
+	defer b.msgsPool.Put(msgs)
+	count := min(len(bufs), len(*msgs))
+	for i := 0; i < count; i++ {
+		(*msgs)[i].Buffers[0] = bufs[i]
+	}
+	n, err := br.ReadBatch((*msgs)[:count], 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		msg := &(*msgs)[i]
+		sizes[i] = msg.N
+		eps[i] = &PacketConnEndpoint{Addr: msg.Addr}
+		msg.Buffers[0] = nil
+		msg.Addr = nil
+	}
+	return n, nil
+}
+
+func (b *PacketConnBind) isClosed(conn net.PacketConn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn != conn
+}
+
+func (b *PacketConnBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	ep, ok := endpoint.(*PacketConnEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return net.ErrClosed
+	}
+
+	if bw, ok := conn.(batchWriter); ok && len(bufs) > 1 {
+		msgs := b.msgsPool.Get().(*[]ipv6.Message)
+		defer b.msgsPool.Put(msgs)
+		for len(bufs) > 0 {
+			count := min(len(bufs), len(*msgs))
+			for i := 0; i < count; i++ {
+				(*msgs)[i].Buffers[0] = bufs[i]
+				(*msgs)[i].Addr = ep.Addr
+			}
+			n, err := bw.WriteBatch((*msgs)[:count], 0)
+			for i := 0; i < count; i++ {
+				(*msgs)[i].Buffers[0] = nil
+				(*msgs)[i].Addr = nil
+			}
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return io.ErrShortWrite
+			}
+			bufs = bufs[n:]
+		}
+		return nil
+	}
+
+	for _, buf := range bufs {
+		if _, err := conn.WriteTo(buf, ep.Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
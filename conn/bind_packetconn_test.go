@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func listenLoopback(port uint16) (net.PacketConn, error) {
+	return net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+}
+
+func TestPacketConnBindSendReceive(t *testing.T) {
+	a, b := NewPacketConnBind(listenLoopback), NewPacketConnBind(listenLoopback)
+	_, portA, err := a.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	fnsB, portB, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if portA == 0 || portB == 0 {
+		t.Fatal("actual port not reported")
+	}
+
+	ep, err := a.ParseEndpoint(net.JoinHostPort("127.0.0.1", strconv.Itoa(int(portB))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := [][]byte{[]byte("one"), []byte("two")}
+	if err := a.Send(msgs, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := make([][]byte, b.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, len(bufs))
+	eps := make([]Endpoint, len(bufs))
+	for received := 0; received < len(msgs); {
+		n, err := fnsB[0](bufs, sizes, eps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if !bytes.Equal(bufs[i][:sizes[i]], msgs[received]) {
+				t.Errorf("received %q, want %q", bufs[i][:sizes[i]], msgs[received])
+			}
+			if got, want := eps[i].DstToString(), net.JoinHostPort("127.0.0.1", strconv.Itoa(int(portA))); got != want {
+				t.Errorf("source is %s, want %s", got, want)
+			}
+			received++
+		}
+	}
+}
+
+// eofConn reports io.EOF instead of net.ErrClosed once closed.
+type eofConn struct {
+	net.PacketConn
+}
+
+func (c eofConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		err = io.EOF
+	}
+	return n, addr, err
+}
+
+func TestPacketConnBindClose(t *testing.T) {
+	bind := NewPacketConnBind(func(port uint16) (net.PacketConn, error) {
+		conn, err := listenLoopback(port)
+		return eofConn{conn}, err
+	})
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bind.Open(0); !errors.Is(err, ErrBindAlreadyOpen) {
+		t.Errorf("second Open returned %v, want %v", err, ErrBindAlreadyOpen)
+	}
+	if err := bind.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bufs := [][]byte{make([]byte, 1500)}
+	_, err = fns[0](bufs, make([]int, 1), make([]Endpoint, 1))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReceiveFunc returned %v after Close, want %v", err, net.ErrClosed)
+	}
+}
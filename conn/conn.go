@@ -71,6 +71,20 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// RelayBind is implemented by Bind objects that can forward datagrams to a
+// peer through a relay server, for use when the peer cannot be reached
+// directly. The relay only ever sees encrypted WireGuard messages.
+type RelayBind interface {
+	// RelayEndpoint returns an endpoint that reaches the peer with the
+	// given public key through the relay.
+	RelayEndpoint(publicKey [32]byte) (Endpoint, error)
+
+	// IsRelayed reports whether ep reaches its peer through the relay,
+	// either because it was returned by RelayEndpoint or because it is
+	// the source of a datagram that arrived through the relay.
+	IsRelayed(ep Endpoint) bool
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst: the remote address of a peer ("endpoint" in uapi terminology)
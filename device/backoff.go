@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// MaxHandshakeBackoff is the highest backoff ceiling a peer may have.
+const MaxHandshakeBackoff = time.Hour
+
+// handshakeBackoff holds how a peer retries handshakes. By default an
+// unanswered handshake initiation is retried after RekeyTimeout. With a
+// backoff ceiling set for a peer, the wait doubles with each initiation left
+// unanswered, up to the ceiling, until a handshake completes; staged packets
+// do not cut it short, nor restart the count of attempts, so that peers that
+// are gone cost little. A passive peer is never sent initiations at all,
+// only responses to its own.
+type handshakeBackoff struct {
+	max      atomic.Int64  // ceiling, in nanoseconds, or zero for no backoff
+	failures atomic.Uint32 // initiations unanswered since the last handshake completed
+	delay    atomic.Int64  // how long to wait for a response to the last initiation sent, or zero for RekeyTimeout
+	passive  atomic.Bool   // whether never to initiate handshakes
+}
+
+// backingOff reports whether the peer has a backoff ceiling and initiations
+// have gone unanswered since the last handshake completed.
+func (peer *Peer) backingOff() bool {
+	return peer.backoff.max.Load() != 0 && peer.backoff.failures.Load() != 0
+}
+
+// handshakeRetryDelay returns how long to wait after the last initiation
+// sent before sending another.
+func (peer *Peer) handshakeRetryDelay() time.Duration {
+	if delay := time.Duration(peer.backoff.delay.Load()); delay != 0 {
+		return delay
+	}
+	return RekeyTimeout
+}
+
+// nextHandshakeRetryDelay returns how long to wait for a response to an
+// initiation being sent, and keeps it for handshakeRetryDelay.
+func (peer *Peer) nextHandshakeRetryDelay() time.Duration {
+	delay := RekeyTimeout
+	ceiling := time.Duration(peer.backoff.max.Load())
+	for failures := peer.backoff.failures.Load(); failures > 0 && delay < ceiling; failures-- {
+		delay *= 2
+	}
+	if ceiling > RekeyTimeout {
+		delay = min(delay, ceiling)
+	}
+	peer.backoff.delay.Store(int64(delay))
+	return delay
+}
+
+// resetHandshakeBackoff is called when a handshake completes, or the peer
+// is started afresh.
+func (peer *Peer) resetHandshakeBackoff() {
+	peer.backoff.failures.Store(0)
+	peer.backoff.delay.Store(0)
+}
+
+func (peer *Peer) setHandshakeBackoffMax(d time.Duration) {
+	peer.backoff.max.Store(int64(min(d, MaxHandshakeBackoff)))
+}
@@ -0,0 +1,327 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"math"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	DefaultBanTime    = time.Minute
+	DefaultBanMaxTime = time.Hour
+	BanOffenceWindow  = time.Second * 10
+	BanPrefixIPv4     = 32      // bits of the source address that offences count against
+	BanPrefixIPv6     = 64      // likewise, for IPv6 sources
+	MaxBanSources     = 1 << 14 // maximum number of prefixes whose offences are tracked
+)
+
+// BanPolicy configures automatic bans of sources whose handshake messages
+// keep failing, counted against the prefix of BanPrefixIPv4 or BanPrefixIPv6
+// bits around the source address: messages that are malformed, fail MAC1,
+// lack a valid MAC2 while the device is under load, or fail authentication.
+// Each ban lasts twice as long as the one before, up to MaxDuration. A zero
+// Threshold disables automatic bans.
+type BanPolicy struct {
+	Threshold   int           // offences within BanOffenceWindow that get a source banned
+	Duration    time.Duration // length of the first ban, or zero for DefaultBanTime
+	MaxDuration time.Duration // longest ban, or zero for DefaultBanMaxTime
+}
+
+func (policy BanPolicy) duration() time.Duration {
+	if policy.Duration <= 0 {
+		return DefaultBanTime
+	}
+	return policy.Duration
+}
+
+func (policy BanPolicy) maxDuration() time.Duration {
+	if policy.MaxDuration <= 0 {
+		return max(DefaultBanMaxTime, policy.duration())
+	}
+	return max(policy.MaxDuration, policy.duration())
+}
+
+// A Ban is a prefix whose handshake messages are dropped.
+type Ban struct {
+	Prefix netip.Prefix
+	Until  time.Time // zero if the ban lasts until lifted
+}
+
+// offensive reports whether failure is one a source has no business causing
+// repeatedly. Replays, floods and stale responses are not: they happen to
+// honest peers whose packets are duplicated or delayed. A missing MAC2 is,
+// as an honest peer retries with the cookie it was sent, no sooner than
+// RekeyTimeout later.
+func (failure HandshakeFailure) offensive() bool {
+	switch failure {
+	case HandshakeFailureMalformed,
+		HandshakeFailureInvalidMAC1,
+		HandshakeFailureMissingMAC2,
+		HandshakeFailureInvalidKey,
+		HandshakeFailureWrongRecipient,
+		HandshakeFailureUnknownPeer,
+		HandshakeFailureAuthentication,
+		HandshakeFailureEndpointNotAllowed:
+		return true
+	}
+	return false
+}
+
+type banList struct {
+	sync.RWMutex
+	policy    BanPolicy
+	threshold atomic.Int32               // policy.Threshold, to skip locking when bans are disabled
+	bans      map[netip.Prefix]time.Time // by masked prefix, to when they end
+	lengths   map[int]int                // number of bans of each prefix length
+	count     atomic.Int32               // len(bans), to skip locking when there are none
+	sources   map[netip.Prefix]*banSource
+}
+
+// A banSource is the record of offences of a prefix.
+type banSource struct {
+	offences    int       // offences since windowStart
+	windowStart time.Time // start of the current BanOffenceWindow
+	strikes     int       // bans so far
+	lastSeen    time.Time // last offence, or end of last ban
+}
+
+func banPrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := BanPrefixIPv4
+	if addr.Is6() {
+		bits = BanPrefixIPv6
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// SetBanPolicy sets the policy for banning sources automatically. Bans in
+// effect are kept.
+func (device *Device) SetBanPolicy(policy BanPolicy) {
+	device.bans.Lock()
+	defer device.bans.Unlock()
+	device.bans.policy = policy
+	device.bans.threshold.Store(int32(min(max(policy.Threshold, 0), math.MaxInt32)))
+}
+
+func (device *Device) BanPolicy() BanPolicy {
+	device.bans.RLock()
+	defer device.bans.RUnlock()
+	return device.bans.policy
+}
+
+// Ban drops handshake messages from prefix for d, or until Unban if d is
+// zero, replacing any ban of the same prefix.
+func (device *Device) Ban(prefix netip.Prefix, d time.Duration) error {
+	if !prefix.IsValid() {
+		return errors.New("invalid prefix")
+	}
+	var until time.Time
+	if d > 0 {
+		until = device.now().Add(d)
+	}
+	device.bans.Lock()
+	defer device.bans.Unlock()
+	device.bans.addLocked(prefix.Masked(), until)
+	return nil
+}
+
+// Unban lifts the ban of prefix, if any, and forgets earlier bans of it.
+func (device *Device) Unban(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	device.bans.Lock()
+	defer device.bans.Unlock()
+	device.bans.removeLocked(prefix)
+	delete(device.bans.sources, prefix)
+}
+
+// Bans returns the bans in effect, ordered by prefix.
+func (device *Device) Bans() []Ban {
+	now := device.now()
+	device.bans.Lock()
+	defer device.bans.Unlock()
+	device.bans.pruneLocked(now)
+	bans := make([]Ban, 0, len(device.bans.bans))
+	for prefix, until := range device.bans.bans {
+		bans = append(bans, Ban{Prefix: prefix, Until: until})
+	}
+	slices.SortFunc(bans, func(a, b Ban) int {
+		if c := a.Prefix.Addr().Compare(b.Prefix.Addr()); c != 0 {
+			return c
+		}
+		return a.Prefix.Bits() - b.Prefix.Bits()
+	})
+	return bans
+}
+
+func (bans *banList) addLocked(prefix netip.Prefix, until time.Time) {
+	if bans.bans == nil {
+		bans.bans = make(map[netip.Prefix]time.Time)
+		bans.lengths = make(map[int]int)
+	}
+	if _, ok := bans.bans[prefix]; !ok {
+		bans.lengths[prefix.Bits()]++
+		bans.count.Add(1)
+	}
+	bans.bans[prefix] = until
+}
+
+func (bans *banList) removeLocked(prefix netip.Prefix) {
+	if _, ok := bans.bans[prefix]; !ok {
+		return
+	}
+	delete(bans.bans, prefix)
+	if bans.lengths[prefix.Bits()]--; bans.lengths[prefix.Bits()] == 0 {
+		delete(bans.lengths, prefix.Bits())
+	}
+	bans.count.Add(-1)
+}
+
+// pruneLocked removes bans that have ended, and the records of sources that
+// have since behaved long enough to be forgotten.
+func (bans *banList) pruneLocked(now time.Time) {
+	for prefix, until := range bans.bans {
+		if !until.IsZero() && !now.Before(until) {
+			bans.removeLocked(prefix)
+		}
+	}
+	forget := max(bans.policy.maxDuration(), BanOffenceWindow)
+	for prefix, source := range bans.sources {
+		if now.Sub(source.lastSeen) > forget {
+			delete(bans.sources, prefix)
+		}
+	}
+}
+
+func (bans *banList) bannedLocked(addr netip.Addr, now time.Time) bool {
+	for bits := range bans.lengths {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if until, ok := bans.bans[prefix]; ok && (until.IsZero() || now.Before(until)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeSourceBanned reports whether handshake messages from endpoint
+// are to be dropped.
+func (device *Device) handshakeSourceBanned(endpoint conn.Endpoint) bool {
+	if device.bans.count.Load() == 0 {
+		return false
+	}
+	addr := endpoint.DstIP().Unmap()
+	now := device.now()
+	device.bans.RLock()
+	defer device.bans.RUnlock()
+	return device.bans.bannedLocked(addr, now)
+}
+
+// handshakeOffence counts failure, the reason a handshake message from
+// endpoint was dropped, as an offence by its source address if failure is
+// offensive, banning the source if that makes too many.
+func (device *Device) handshakeOffence(endpoint conn.Endpoint, failure HandshakeFailure) {
+	bans := &device.bans
+	if bans.threshold.Load() == 0 || !failure.offensive() {
+		return
+	}
+	bans.Lock()
+	defer bans.Unlock()
+
+	policy := bans.policy
+	if policy.Threshold <= 0 {
+		return
+	}
+	addr := endpoint.DstIP().Unmap()
+	now := device.now()
+	if bans.bannedLocked(addr, now) {
+		return
+	}
+	prefix := banPrefix(addr)
+	source := bans.sources[prefix]
+	if source == nil {
+		if len(bans.sources) >= MaxBanSources {
+			bans.pruneLocked(now)
+			if len(bans.sources) >= MaxBanSources {
+				return
+			}
+		}
+		if bans.sources == nil {
+			bans.sources = make(map[netip.Prefix]*banSource)
+		}
+		source = &banSource{windowStart: now}
+		bans.sources[prefix] = source
+	}
+	if source.strikes > 0 && now.Sub(source.lastSeen) > policy.maxDuration() {
+		source.strikes = 0
+	}
+	if now.Sub(source.windowStart) > BanOffenceWindow {
+		source.offences = 0
+		source.windowStart = now
+	}
+	source.offences++
+	source.lastSeen = now
+	if source.offences < policy.Threshold {
+		return
+	}
+
+	d := policy.duration()
+	for i := 0; i < source.strikes && d < policy.maxDuration(); i++ {
+		d *= 2
+	}
+	d = min(d, policy.maxDuration())
+	source.strikes++
+	source.offences = 0
+	source.windowStart = now
+	source.lastSeen = now.Add(d)
+	bans.addLocked(prefix, now.Add(d))
+	device.log.Verbosef("Banning %v for %v after repeated handshake failures: %v", prefix, d, failure)
+}
+
+// parseBan parses the value of a UAPI ban key: a prefix or address,
+// optionally followed by a comma and the duration of the ban in seconds.
+func parseBan(value string) (prefix netip.Prefix, d time.Duration, err error) {
+	value, secs, hasSecs := strings.Cut(value, ",")
+	if strings.Contains(value, "/") {
+		prefix, err = netip.ParsePrefix(value)
+	} else {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(value)
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if err != nil {
+		return prefix, 0, err
+	}
+	if hasSecs {
+		n, err := strconv.ParseUint(secs, 10, 32)
+		if err != nil {
+			return prefix, 0, err
+		}
+		d = time.Duration(n) * time.Second
+	}
+	return prefix, d, nil
+}
+
+// formatBan formats ban for UAPI get, with the whole seconds it has left.
+func formatBan(ban Ban, now time.Time) string {
+	if ban.Until.IsZero() {
+		return ban.Prefix.String()
+	}
+	secs := int64((ban.Until.Sub(now) + time.Second - 1) / time.Second)
+	return ban.Prefix.String() + "," + strconv.FormatInt(secs, 10)
+}
@@ -8,6 +8,7 @@ package device
 import (
 	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 // An outboundQueue is a channel of QueueOutboundElements awaiting encryption.
@@ -53,24 +54,80 @@ func newInboundQueue() *inboundQueue {
 	return q
 }
 
-// A handshakeQueue is similar to an outboundQueue; see those docs.
+// A handshakeQueue is similar to an outboundQueue; see those docs. It has
+// a channel per handshakeClass, which receive drains in order of priority.
 type handshakeQueue struct {
-	c  chan QueueHandshakeElement
-	wg sync.WaitGroup
+	c       [numHandshakeClasses]chan QueueHandshakeElement
+	dropped [numHandshakeClasses]atomic.Uint64 // messages dropped on a full channel
+	wg      sync.WaitGroup
 }
 
 func newHandshakeQueue() *handshakeQueue {
-	q := &handshakeQueue{
-		c: make(chan QueueHandshakeElement, QueueHandshakeSize),
+	q := &handshakeQueue{}
+	for class := range q.c {
+		q.c[class] = make(chan QueueHandshakeElement, handshakeClass(class).queueSize())
 	}
 	q.wg.Add(1)
 	go func() {
 		q.wg.Wait()
-		close(q.c)
+		for _, c := range q.c {
+			close(c)
+		}
 	}()
 	return q
 }
 
+// send queues elem in the channel of class, or counts it as dropped if
+// that is full.
+func (q *handshakeQueue) send(class handshakeClass, elem QueueHandshakeElement) bool {
+	select {
+	case q.c[class] <- elem:
+		return true
+	default:
+		q.dropped[class].Add(1)
+		return false
+	}
+}
+
+// receive returns the next element of the highest priority class that has
+// one, waiting if there is none. It returns false once the queue is closed
+// and drained.
+func (q *handshakeQueue) receive() (QueueHandshakeElement, bool) {
+	for {
+		closed := 0
+		for _, c := range q.c {
+			select {
+			case elem, ok := <-c:
+				if ok {
+					return elem, true
+				}
+				closed++
+			default:
+			}
+		}
+		if closed == len(q.c) {
+			return QueueHandshakeElement{}, false
+		}
+		var elem QueueHandshakeElement
+		var ok bool
+		select {
+		case elem, ok = <-q.c[handshakeClassReply]:
+		case elem, ok = <-q.c[handshakeClassKnown]:
+		case elem, ok = <-q.c[handshakeClassUnknown]:
+		}
+		if ok {
+			return elem, true
+		}
+	}
+}
+
+func (q *handshakeQueue) len() (n int) {
+	for _, c := range q.c {
+		n += len(c)
+	}
+	return n
+}
+
 type autodrainingInboundQueue struct {
 	c chan *QueueInboundElementsContainer
 }
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock is the source of time for a device: its timers, handshake and
+// cookie timestamps, session expiry, load detection and rate limiting.
+// Replacing it with a FakeClock lets tests step through minutes of protocol
+// time in an instant.
+type Clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine once d has elapsed, like
+	// time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) ClockTimer
+}
+
+// A ClockTimer is a timer returned by Clock.AfterFunc, with the semantics of
+// the methods of time.Timer.
+type ClockTimer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// SystemClock is the Clock of a device unless given another with WithClock.
+var SystemClock Clock = systemClock{}
+
+// WithClock makes a device take time from clock.
+func WithClock(clock Clock) DeviceOption {
+	return func(device *Device) {
+		device.clock = clock
+	}
+}
+
+func (device *Device) now() time.Time {
+	return device.clock.Now()
+}
+
+func (device *Device) since(t time.Time) time.Duration {
+	return device.clock.Now().Sub(t)
+}
+
+// clockNow returns the time of clock, or of the system if it is nil, for
+// state that may be used without a device.
+func clockNow(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
+
+// FakeClock is a Clock whose time only moves when told to. Timers fire
+// during Advance, in order of expiry, each seeing the time it expired at.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{} // pending timers
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	f     func()
+}
+
+var _ Clock = (*FakeClock)(nil)
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:    now,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) ClockTimer {
+	t := &fakeTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, running the function of every timer
+// that expires on the way. Unlike with the system clock, the functions run
+// one at a time on the calling goroutine, so that once Advance returns, all
+// they did is done. Timers they set which expire within d fire too.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for t := range c.timers {
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		delete(c.timers, next)
+		if next.when.After(c.now) {
+			c.now = next.when
+		}
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, pending := t.clock.timers[t]
+	t.when = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	return pending
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
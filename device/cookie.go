@@ -25,6 +25,7 @@ type CookieChecker struct {
 		secretSet     time.Time
 		encryptionKey [chacha20poly1305.KeySize]byte
 	}
+	clock Clock // nil for the system clock
 }
 
 type CookieGenerator struct {
@@ -39,6 +40,7 @@ type CookieGenerator struct {
 		lastMAC1      [blake2s.Size128]byte
 		encryptionKey [chacha20poly1305.KeySize]byte
 	}
+	clock Clock // nil for the system clock
 }
 
 func (st *CookieChecker) Init(pk NoisePublicKey) {
@@ -87,7 +89,7 @@ func (st *CookieChecker) CheckMAC2(msg, src []byte) bool {
 	st.RLock()
 	defer st.RUnlock()
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if clockNow(st.clock).Sub(st.mac2.secretSet) > CookieRefreshTime {
 		return false
 	}
 
@@ -123,7 +125,7 @@ func (st *CookieChecker) CreateReply(
 
 	// refresh cookie secret
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if clockNow(st.clock).Sub(st.mac2.secretSet) > CookieRefreshTime {
 		st.RUnlock()
 		st.Lock()
 		_, err := rand.Read(st.mac2.secret[:])
@@ -131,7 +133,7 @@ func (st *CookieChecker) CreateReply(
 			st.Unlock()
 			return nil, err
 		}
-		st.mac2.secretSet = time.Now()
+		st.mac2.secretSet = clockNow(st.clock)
 		st.Unlock()
 		st.RLock()
 	}
@@ -207,7 +209,7 @@ func (st *CookieGenerator) ConsumeReply(msg *MessageCookieReply) bool {
 		return false
 	}
 
-	st.mac2.cookieSet = time.Now()
+	st.mac2.cookieSet = clockNow(st.clock)
 	st.mac2.cookie = cookie
 	return true
 }
@@ -236,7 +238,7 @@ func (st *CookieGenerator) AddMacs(msg []byte) {
 
 	// set mac2
 
-	if time.Since(st.mac2.cookieSet) > CookieRefreshTime {
+	if clockNow(st.clock).Sub(st.mac2.cookieSet) > CookieRefreshTime {
 		return
 	}
 
@@ -14,6 +14,7 @@ import (
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ratelimiter"
 	"golang.zx2c4.com/wireguard/rwcancel"
+	"golang.zx2c4.com/wireguard/tai64n"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
@@ -40,7 +41,9 @@ type Device struct {
 	net struct {
 		stopping sync.WaitGroup
 		sync.RWMutex
-		bind          conn.Bind // bind interface
+		bind          conn.Bind      // bind interface
+		relay         conn.RelayBind // bind, if it supports relaying; set once by NewDevice
+		keyBind       StaticKeyBind  // bind, if it needs the static key; set once by NewDevice
 		netlinkCancel *rwcancel.RWCancel
 		port          uint16 // listening port
 		fwmark        uint32 // mark value (0 = disabled)
@@ -49,8 +52,10 @@ type Device struct {
 
 	staticIdentity struct {
 		sync.RWMutex
-		privateKey NoisePrivateKey
+		key        StaticKey       // nil if no private key is set
+		privateKey NoisePrivateKey // zero unless key is a SoftwareStaticKey
 		publicKey  NoisePublicKey
+		retiring   *retiringIdentity // previous identity during a key rotation
 	}
 
 	peers struct {
@@ -61,11 +66,45 @@ type Device struct {
 	rate struct {
 		underLoadUntil atomic.Int64
 		limiter        ratelimiter.Ratelimiter
+
+		sync.RWMutex                  // protects custom
+		custom       HandshakeLimiter // replaces limiter, if set
+	}
+
+	resolver struct {
+		sync.RWMutex
+		r EndpointResolver
+	}
+
+	psk struct {
+		sync.RWMutex
+		provider PresharedKeyProvider
+	}
+
+	unknownPeers struct {
+		sync.Mutex
+		handler UnknownPeerHandler
+		pending map[NoisePublicKey]struct{} // keys being looked up
+	}
+
+	handshakeFailures [numHandshakeFailures]atomic.Uint64 // from unknown peers, by reason
+
+	authenticatedSources authenticatedSources
+	bans                 banList
+	load                 loadState
+
+	timestamps struct {
+		sync.Mutex
+		store    TimestampStore
+		floor    tai64n.Timestamp // handshake timestamps sent must be after this
+		reserved tai64n.Timestamp // bound last stored
+		storing  sync.Mutex       // held while storing a new bound
 	}
 
 	allowedips    AllowedIPs
-	indexTable    IndexTable
+	indexTable    *IndexTable // shared by the devices of a SharedBind
 	cookieChecker CookieChecker
+	clock         Clock
 
 	pool struct {
 		inboundElementsContainer  *WaitPool
@@ -86,6 +125,8 @@ type Device struct {
 		mtu    atomic.Int32
 	}
 
+	messageHandlers messageHandlers
+
 	ipcMutex sync.RWMutex
 	closed   chan struct{}
 	log      *Logger
@@ -182,7 +223,7 @@ func (device *Device) upLocked() error {
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.Start()
-		if peer.persistentKeepaliveInterval.Load() > 0 {
+		if peer.keepaliveInterval() > 0 {
 			peer.SendKeepalive()
 		}
 	}
@@ -214,25 +255,40 @@ func (device *Device) Down() error {
 	return device.changeState(deviceStateDown)
 }
 
-func (device *Device) IsUnderLoad() bool {
-	// check if currently under load
-	now := time.Now()
-	underLoad := len(device.queue.handshake.c) >= QueueHandshakeSize/8
-	if underLoad {
-		device.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime).UnixNano())
-		return true
-	}
-	// check if recently under load
-	return device.rate.underLoadUntil.Load() > now.UnixNano()
+func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
+	return device.setStaticKey(NewSoftwareStaticKey(sk), 0)
 }
 
-func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
+func (device *Device) setStaticKey(key StaticKey, transition time.Duration) error {
+	// do static-static DH pre-computations before taking any locks, as key
+	// may have to ask another process for each of them
+
+	precomputed := device.precomputeStaticStatic(key)
+
 	// lock required resources
 
 	device.staticIdentity.Lock()
 	defer device.staticIdentity.Unlock()
 
-	if sk.Equals(device.staticIdentity.privateKey) {
+	// a zero private key removes the identity
+
+	var sk NoisePrivateKey
+	if software, ok := key.(*SoftwareStaticKey); ok {
+		sk = software.privateKey
+		if sk.IsZero() {
+			key = nil
+		}
+	}
+	if key == nil {
+		if device.staticIdentity.key == nil {
+			return nil
+		}
+	} else if device.staticIdentity.key != nil && key.PublicKey().Equals(device.staticIdentity.publicKey) {
+		device.staticIdentity.key = key
+		device.staticIdentity.privateKey = sk
+		if device.net.keyBind != nil {
+			device.net.keyBind.SetStaticKey(key)
+		}
 		return nil
 	}
 
@@ -248,27 +304,61 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	// remove peers with matching public keys
 
 	publicKey := sk.publicKey()
-	for key, peer := range device.peers.keyMap {
+	if key != nil {
+		publicKey = key.PublicKey()
+	}
+	for pk, peer := range device.peers.keyMap {
 		if peer.handshake.remoteStatic.Equals(publicKey) {
 			peer.handshake.mutex.RUnlock()
-			removePeerLocked(device, peer, key)
+			removePeerLocked(device, peer, pk)
 			peer.handshake.mutex.RLock()
 		}
 	}
 
-	// update key material
+	// update key material, keeping the old identity around if rotating
+
+	if device.staticIdentity.retiring != nil {
+		device.staticIdentity.retiring.clear()
+		device.staticIdentity.retiring = nil
+	}
+	var retiring *retiringIdentity
+	if transition > 0 && device.staticIdentity.key != nil {
+		retiring = newRetiringIdentity(device.staticIdentity.key, device.staticIdentity.publicKey)
+		retiring.cookieChecker.clock = device.clock
+		retiring.timer = device.clock.AfterFunc(transition, func() {
+			device.retirePrivateKey(retiring)
+		})
+		device.staticIdentity.retiring = retiring
+	}
 
+	device.staticIdentity.key = key
 	device.staticIdentity.privateKey = sk
 	device.staticIdentity.publicKey = publicKey
 	device.cookieChecker.Init(publicKey)
+	if device.net.keyBind != nil {
+		device.net.keyBind.SetStaticKey(key)
+	}
 
-	// do static-static DH pre-computations
+	// install static-static DH pre-computations
 
 	expiredPeers := make([]*Peer, 0, len(device.peers.keyMap))
 	for _, peer := range device.peers.keyMap {
 		handshake := &peer.handshake
-		handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
-		expiredPeers = append(expiredPeers, peer)
+		if retiring != nil {
+			handshake.retiringStaticStatic = handshake.precomputedStaticStatic
+		} else {
+			setZero(handshake.retiringStaticStatic[:])
+			expiredPeers = append(expiredPeers, peer)
+		}
+		ss, ok := precomputed[handshake.remoteStatic]
+		if !ok {
+			// the peer was added since
+			ss, _ = staticSharedSecret(key, handshake.remoteStatic)
+		}
+		handshake.precomputedStaticStatic = ss
+	}
+	for pk := range precomputed {
+		precomputed[pk] = [NoisePublicKeySize]byte{}
 	}
 
 	for _, peer := range lockedPeers {
@@ -281,12 +371,49 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	return nil
 }
 
-func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
+// precomputeStaticStatic computes the static-static shared secret of key
+// with each peer, unless key is nil or already in use.
+func (device *Device) precomputeStaticStatic(key StaticKey) map[NoisePublicKey][NoisePublicKeySize]byte {
+	if software, ok := key.(*SoftwareStaticKey); key == nil || ok && software.privateKey.IsZero() {
+		return nil
+	}
+	device.staticIdentity.RLock()
+	inUse := device.staticIdentity.key != nil && key.PublicKey().Equals(device.staticIdentity.publicKey)
+	device.staticIdentity.RUnlock()
+	if inUse {
+		return nil
+	}
+
+	device.peers.RLock()
+	remotes := make([]NoisePublicKey, 0, len(device.peers.keyMap))
+	for pk := range device.peers.keyMap {
+		remotes = append(remotes, pk)
+	}
+	device.peers.RUnlock()
+
+	precomputed := make(map[NoisePublicKey][NoisePublicKeySize]byte, len(remotes))
+	for _, pk := range remotes {
+		precomputed[pk], _ = staticSharedSecret(key, pk)
+	}
+	return precomputed
+}
+
+// A DeviceOption configures a Device as NewDevice creates it.
+type DeviceOption func(*Device)
+
+func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger, opts ...DeviceOption) *Device {
 	device := new(Device)
 	device.state.state.Store(uint32(deviceStateDown))
 	device.closed = make(chan struct{})
 	device.log = logger
+	device.clock = SystemClock
+	for _, opt := range opts {
+		opt(device)
+	}
+	device.cookieChecker.clock = device.clock
 	device.net.bind = bind
+	device.net.relay, _ = bind.(conn.RelayBind)
+	device.net.keyBind, _ = bind.(StaticKeyBind)
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
 	if err != nil {
@@ -296,7 +423,14 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.tun.mtu.Store(int32(mtu))
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 	device.rate.limiter.Init()
-	device.indexTable.Init()
+	device.rate.limiter.SetClock(device.clock.Now)
+	if shared, ok := bind.(*sharedBindConn); ok {
+		device.indexTable = &shared.shared.indexTable
+		shared.device.Store(device)
+	} else {
+		device.indexTable = new(IndexTable)
+		device.indexTable.Init()
+	}
 
 	device.PopulatePools()
 
@@ -385,6 +519,13 @@ func (device *Device) Close() {
 	// because peers assume that queues are active.
 	device.RemoveAllPeers()
 
+	device.staticIdentity.Lock()
+	if device.staticIdentity.retiring != nil {
+		device.staticIdentity.retiring.clear()
+		device.staticIdentity.retiring = nil
+	}
+	device.staticIdentity.Unlock()
+
 	// We kept a reference to the encryption and decryption queues,
 	// in case we started any new peers that might write to them.
 	// No new peers are coming; we are done with these queues.
@@ -394,6 +535,7 @@ func (device *Device) Close() {
 	device.state.stopping.Wait()
 
 	device.rate.limiter.Close()
+	device.stopLoadTimer()
 
 	device.log.Verbosef("Device closed")
 	close(device.closed)
@@ -411,7 +553,7 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
+		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(peer.rejectAfterTime()).Before(device.now())
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
 			peer.SendKeepalive()
@@ -7,14 +7,20 @@ package device
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/netip"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -150,6 +156,11 @@ func (pair *testPair) Send(tb testing.TB, ping SendDirection, done chan struct{}
 
 // genTestPair creates a testPair.
 func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
+	return genTestPairWithClock(tb, realSocket, nil)
+}
+
+// genTestPairWithClock creates a testPair whose devices use clock, if set.
+func genTestPairWithClock(tb testing.TB, realSocket bool, clock Clock) (pair testPair) {
 	cfg, endpointCfg := genConfigs(tb)
 	var binds [2]conn.Bind
 	if realSocket {
@@ -166,7 +177,11 @@ func genTestPair(tb testing.TB, realSocket bool) (pair testPair) {
 		if _, ok := tb.(*testing.B); ok && !testing.Verbose() {
 			level = LogLevelError
 		}
-		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)))
+		var opts []DeviceOption
+		if clock != nil {
+			opts = append(opts, WithClock(clock))
+		}
+		p.dev = NewDevice(p.tun.TUN(), binds[i], NewLogger(level, fmt.Sprintf("dev%d: ", i)), opts...)
 		if err := p.dev.IpcSet(cfg[i]); err != nil {
 			tb.Errorf("failed to configure device %d: %v", i, err)
 			p.dev.Close()
@@ -474,3 +489,1403 @@ func TestBatchSize(t *testing.T) {
 		t.Errorf("expected batch size %d, got %d", want, got)
 	}
 }
+
+func TestEndpointCandidates(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "192.0.2.1:51820",
+		"endpoint", "[2001:db8::1]:51820",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+
+	current := func() string {
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		return peer.endpoint.val.DstToString()
+	}
+	for _, want := range []string{"192.0.2.1:51820", "[2001:db8::1]:51820", "192.0.2.1:51820"} {
+		if got := current(); got != want {
+			t.Errorf("current endpoint is %s, want %s", got, want)
+		}
+		peer.failOverEndpoint()
+	}
+
+	// a peer that roamed away from its candidates goes back to the first
+	roamed := &conn.StdNetEndpoint{AddrPort: netip.MustParseAddrPort("203.0.113.1:51820")}
+	peer.SetEndpointFromPacket(roamed)
+	peer.failOverEndpoint()
+	if got, want := current(), "192.0.2.1:51820"; got != want {
+		t.Errorf("current endpoint is %s after failover from roamed endpoint, want %s", got, want)
+	}
+
+	// as does one that may not roam, or only within its address family
+	for _, roaming := range []string{"off", "same_family"} {
+		err = dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pk[:]),
+			"roaming", roaming,
+			"endpoint", "192.0.2.1:51820",
+			"endpoint", "[2001:db8::1]:51820",
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.failOverEndpoint()
+		if got, want := current(), "192.0.2.1:51820"; got != want {
+			t.Errorf("current endpoint is %s after failover with roaming=%s, want %s", got, roaming, want)
+		}
+	}
+
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"roaming", "on",
+		"endpoint", "198.51.100.1:51820",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.endpoint.Lock()
+	n := len(peer.endpoint.candidates)
+	peer.endpoint.Unlock()
+	if n != 1 {
+		t.Errorf("have %d candidates after replacing endpoint, want 1", n)
+	}
+	if got, want := current(), "198.51.100.1:51820"; got != want {
+		t.Errorf("current endpoint is %s, want %s", got, want)
+	}
+}
+
+// recordingBind records where packets are sent.
+type recordingBind struct {
+	fakeBindSized
+	mu   sync.Mutex
+	sent []string
+}
+
+func (b *recordingBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent = append(b.sent, ep.DstToString())
+	return nil
+}
+
+func (b *recordingBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return conn.NewDefaultBind().ParseEndpoint(s)
+}
+
+func (b *recordingBind) takeSent() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sent := b.sent
+	b.sent = nil
+	return sent
+}
+
+func TestEndpointAttemptsStaggered(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	bind := &recordingBind{fakeBindSized: fakeBindSized{size: 1}}
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bind, NewLogger(LogLevelError, ""), WithClock(clock))
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.SetPrivateKey(sk)
+	peerSK, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := peerSK.publicKey()
+	candidates := []string{"192.0.2.1:51820", "192.0.2.2:51820", "192.0.2.3:51820"}
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", candidates[0],
+		"endpoint", candidates[1],
+		"endpoint", candidates[2],
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+	peer.Start()
+
+	config, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "endpoint=" + strings.Join(candidates, "\nendpoint=") + "\n"; !strings.Contains(config, want) {
+		t.Errorf("candidates not all reported:\n%s", config)
+	}
+
+	send := func() {
+		t.Helper()
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Time{}
+		peer.handshake.mutex.Unlock()
+		if err := peer.SendHandshakeInitiation(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		if got := bind.takeSent(); !slices.Equal(got, want) {
+			t.Errorf("initiation sent to %v, want %v", got, want)
+		}
+	}
+
+	// the other candidates are tried one at a time
+	send()
+	expect(candidates[0])
+	clock.Advance(EndpointAttemptDelay)
+	expect(candidates[1])
+	clock.Advance(EndpointAttemptDelay)
+	expect(candidates[2])
+	clock.Advance(EndpointAttemptDelay)
+	expect()
+
+	// and no longer once a newer initiation was sent
+	send()
+	expect(candidates[0])
+	send()
+	expect(candidates[0])
+	clock.Advance(EndpointAttemptDelay)
+	expect(candidates[1])
+}
+
+type fakeResolver struct {
+	mu    sync.Mutex
+	addrs map[string][]netip.AddrPort
+}
+
+func (r *fakeResolver) ResolveEndpoint(ctx context.Context, name string) ([]netip.AddrPort, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs, ok := r.addrs[name]
+	if !ok {
+		return nil, 0, errors.New("no such host")
+	}
+	return addrs, time.Minute, nil
+}
+
+func (r *fakeResolver) set(name string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs[name] = nil
+	for _, addr := range addrs {
+		r.addrs[name] = append(r.addrs[name], netip.MustParseAddrPort(addr))
+	}
+}
+
+func TestEndpointNames(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		name bool
+	}{
+		{"192.0.2.1:51820", false},
+		{"[2001:db8::1]:51820", false},
+		{"vpn.example.com:51820", true},
+		{"_wireguard._udp.example.com", true},
+		{"vpn.example.com", false},
+		{":51820", false},
+	} {
+		if got := isEndpointName(test.s); got != test.name {
+			t.Errorf("isEndpointName(%q) = %v, want %v", test.s, got, test.name)
+		}
+	}
+
+	dev := randDevice(t)
+	defer dev.Close()
+	resolver := &fakeResolver{addrs: make(map[string][]netip.AddrPort)}
+	dev.SetEndpointResolver(resolver)
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	resolver.set("vpn.example.com:51820", "192.0.2.1:51820", "[2001:db8::1]:51820")
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "vpn.example.com:51820",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+	current := func() string {
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		if peer.endpoint.val == nil {
+			return ""
+		}
+		return peer.endpoint.val.DstToString()
+	}
+	// Names are resolved in the background.
+	for deadline := time.Now().Add(5 * time.Second); current() == "" && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := current(), "192.0.2.1:51820"; got != want {
+		t.Errorf("current endpoint is %s, want %s", got, want)
+	}
+	config, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "endpoint=vpn.example.com:51820\n") || strings.Contains(config, "endpoint=192.0.2.1") {
+		t.Errorf("endpoint name not reported in place of its addresses:\n%s", config)
+	}
+
+	// The name moves; follow it.
+	resolver.set("vpn.example.com:51820", "192.0.2.2:51820")
+	peer.resolveEndpoint()
+	if got, want := current(), "192.0.2.2:51820"; got != want {
+		t.Errorf("current endpoint after re-resolution is %s, want %s", got, want)
+	}
+
+	// The peer roams; the roamed endpoint survives re-resolution, even to
+	// new addresses, until handshakes fail over to them.
+	roamed, err := dev.net.bind.ParseEndpoint("198.51.100.7:4242")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.SetEndpointFromPacket(roamed)
+	peer.resolveEndpoint()
+	if got, want := current(), "198.51.100.7:4242"; got != want {
+		t.Errorf("current endpoint after roaming is %s, want %s", got, want)
+	}
+	resolver.set("vpn.example.com:51820", "192.0.2.3:51820")
+	peer.resolveEndpoint()
+	if got, want := current(), "198.51.100.7:4242"; got != want {
+		t.Errorf("current endpoint after roaming and re-resolution is %s, want %s", got, want)
+	}
+	peer.failOverEndpoint()
+	if got, want := current(), "192.0.2.3:51820"; got != want {
+		t.Errorf("current endpoint after failing over from roamed endpoint is %s, want %s", got, want)
+	}
+
+	// Resolution does not hold up configuration.
+	slow := &blockingResolver{release: make(chan struct{})}
+	dev.SetEndpointResolver(slow)
+	defer close(slow.release)
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "slow.example.com:51820",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type blockingResolver struct {
+	release chan struct{}
+}
+
+func (r *blockingResolver) ResolveEndpoint(ctx context.Context, name string) ([]netip.AddrPort, time.Duration, error) {
+	<-r.release
+	return nil, 0, errors.New("no such host")
+}
+
+func TestUnknownPeerHandler(t *testing.T) {
+	pair := genTestPair(t, false)
+	initiator := pair[0].dev.staticIdentity.publicKey
+	responder := pair[1].dev
+	responder.RemovePeer(initiator)
+
+	var calls atomic.Int32
+	responder.SetUnknownPeerHandler(func(ctx context.Context, pk NoisePublicKey, endpoint conn.Endpoint) (string, error) {
+		calls.Add(1)
+		if pk != initiator {
+			return "", errors.New("unexpected public key")
+		}
+		return "allowed_ip=1.0.0.1/32\n", nil
+	})
+
+	// pair[0] initiates to pair[1], which only then learns of it
+	pair.Send(t, Pong, nil)
+	if responder.LookupPeer(initiator) == nil {
+		t.Fatal("unknown peer not added")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+
+	// Provisioned peers stay until removed; once removed, the next
+	// initiation asks the handler again.
+	responder.RemovePeer(initiator)
+	pair[0].dev.LookupPeer(responder.staticIdentity.publicKey).ExpireCurrentKeypairs()
+	pair.Send(t, Pong, nil)
+	if responder.LookupPeer(initiator) == nil {
+		t.Fatal("removed unknown peer not added again")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("handler called %d times, want 2", n)
+	}
+}
+
+func TestUnknownPeerConfig(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	other, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPK := other.publicKey()
+	privateKey := dev.staticIdentity.privateKey
+
+	for _, config := range []string{
+		"listen_port=1\n",
+		"private_key=" + hex.EncodeToString(other[:]) + "\n",
+		"replace_peers=true\n",
+		"allowed_ip=10.0.0.2/32\npublic_key=" + hex.EncodeToString(otherPK[:]) + "\nallowed_ip=0.0.0.0/0\n",
+		"remove=true\n",
+		"update_only=true\n",
+		"allowed_ip\n",
+	} {
+		if err := dev.ipcSetUnknownPeer(pk, config); err == nil {
+			t.Errorf("config %q accepted", config)
+		}
+		if dev.LookupPeer(pk) != nil {
+			t.Errorf("peer left behind by rejected config %q", config)
+		}
+	}
+	if dev.staticIdentity.privateKey != privateKey {
+		t.Error("handler config changed the private key")
+	}
+	if dev.LookupPeer(otherPK) != nil {
+		t.Error("handler config added another peer")
+	}
+
+	if err := dev.ipcSetUnknownPeer(pk, "allowed_ip=10.0.0.2/32\npersistent_keepalive_interval=25\n"); err != nil {
+		t.Fatal(err)
+	}
+	if dev.LookupPeer(pk) == nil {
+		t.Fatal("peer not added")
+	}
+}
+
+func TestEndpointAllowedIPs(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[1].dev
+	peer := dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	pk := hex.EncodeToString(peer.handshake.remoteStatic[:])
+
+	if err := dev.IpcSet(uapiCfg("public_key", pk, "endpoint_allowed_ips", "192.0.2.0/24, 2001:db8::/32")); err != nil {
+		t.Fatal(err)
+	}
+	config, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "endpoint_allowed_ips=192.0.2.0/24,2001:db8::/32\n") {
+		t.Errorf("endpoint allowed IPs not reported:\n%s", config)
+	}
+	if strings.Contains(config, "endpoint_rejected_count=") {
+		t.Errorf("zero endpoint_rejected_count reported:\n%s", config)
+	}
+
+	// pair[0] initiates from 127.0.0.1, which is not allowed
+	pair[0].tun.Outbound <- tuntest.Ping(pair[1].ip, pair[0].ip)
+	deadline := time.Now().Add(5 * time.Second)
+	for peer.rejectedEndpoints.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("handshake from disallowed endpoint not rejected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if keypair := peer.keypairs.Current(); keypair != nil {
+		t.Fatal("session established from disallowed endpoint")
+	}
+	config, err = dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "endpoint_rejected_count=") {
+		t.Errorf("endpoint_rejected_count not reported:\n%s", config)
+	}
+
+	if err := dev.IpcSet(uapiCfg("public_key", pk, "endpoint_allowed_ips", "127.0.0.0/8")); err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+}
+
+func TestRoamingPolicy(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(s string) conn.Endpoint {
+		ep, err := dev.net.bind.ParseEndpoint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ep
+	}
+	set := func(k, v string) {
+		if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), k, v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := func() string {
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		return peer.endpoint.val.DstToString()
+	}
+
+	roamCounts := func() string {
+		config, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var counts []string
+		for _, line := range strings.Split(config, "\n") {
+			if strings.HasPrefix(line, "roam_") {
+				counts = append(counts, line)
+			}
+		}
+		return strings.Join(counts, " ")
+	}
+	if counts := roamCounts(); counts != "" {
+		t.Errorf("zero roam counts reported: %s", counts)
+	}
+
+	v4a, v4b, v6 := "192.0.2.1:51820", "192.0.2.2:51820", "[2001:db8::1]:51820"
+	peer.SetEndpointFromPacket(parse(v4a))
+
+	set("roaming", "off")
+	peer.SetEndpointFromPacket(parse(v4b))
+	if got := current(); got != v4a {
+		t.Errorf("roamed to %s with roaming off", got)
+	}
+	viaRelay := func() bool {
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		return peer.endpoint.viaRelay
+	}
+	peer.endpoint.Lock()
+	peer.endpoint.viaRelay = true
+	peer.endpoint.Unlock()
+	peer.SetEndpointFromPacket(parse(v4b))
+	if !viaRelay() {
+		t.Error("left relay for a direct path roaming does not allow")
+	}
+	peer.SetEndpointFromPacket(parse(v4a))
+	if viaRelay() {
+		t.Error("did not leave relay for the current direct endpoint")
+	}
+	peer.endpoint.Lock()
+	peer.endpoint.relay = parse(v4b)
+	peer.endpoint.Unlock()
+	peer.fallBackToRelay()
+	if viaRelay() {
+		t.Error("fell back to relay with roaming off")
+	}
+	set("roaming", "on")
+	peer.fallBackToRelay()
+	if !viaRelay() {
+		t.Error("did not fall back to relay with roaming on")
+	}
+	peer.SetEndpointFromPacket(parse(v4a))
+	peer.endpoint.Lock()
+	peer.endpoint.relay = nil
+	peer.endpoint.Unlock()
+
+	set("roaming", "same_family")
+	peer.SetEndpointFromPacket(parse(v6))
+	if got := current(); got != v4a {
+		t.Errorf("roamed to %s across families", got)
+	}
+	peer.SetEndpointFromPacket(parse(v4b))
+	if got := current(); got != v4b {
+		t.Errorf("did not roam within family, endpoint is %s", got)
+	}
+
+	set("roaming", "on")
+	set("roaming_threshold", "3")
+	for i := 0; i < 2; i++ {
+		peer.SetEndpointFromPacket(parse(v6))
+	}
+	peer.SetEndpointFromPacket(parse(v4b)) // interrupts the streak
+	for i := 0; i < 2; i++ {
+		peer.SetEndpointFromPacket(parse(v6))
+	}
+	if got := current(); got != v4b {
+		t.Errorf("roamed to %s below threshold", got)
+	}
+	peer.SetEndpointFromPacket(parse(v6))
+	if got := current(); got != v6 {
+		t.Errorf("did not roam at threshold, endpoint is %s", got)
+	}
+
+	if accepted, suppressed := peer.roamsAccepted.Load(), peer.roamsSuppressed.Load(); accepted != 2 || suppressed != 3 {
+		t.Errorf("counted %d accepted and %d suppressed roams, want 2 and 3", accepted, suppressed)
+	}
+	if got, want := roamCounts(), "roam_accepted_count=2 roam_suppressed_count=3"; got != want {
+		t.Errorf("roam counts reported as %q, want %q", got, want)
+	}
+	if _, err := parseRoamingMode("sometimes"); err == nil {
+		t.Error("invalid roaming mode accepted")
+	}
+}
+
+func TestRekeyPolicy(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(k, v string) error {
+		return dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), k, v))
+	}
+	check := func(rekey, reject time.Duration) {
+		t.Helper()
+		if got := peer.rekeyAfterTime(); got != rekey {
+			t.Errorf("rekey after %v, want %v", got, rekey)
+		}
+		if got := peer.rejectAfterTime(); got != reject {
+			t.Errorf("reject after %v, want %v", got, reject)
+		}
+	}
+
+	check(RekeyAfterTime, RejectAfterTime)
+	if err := set("rekey_after_time", "30"); err != nil {
+		t.Fatal(err)
+	}
+	check(30*time.Second, 45*time.Second)
+	if err := set("reject_after_time", "30"); err != nil {
+		t.Fatal(err)
+	}
+	check(20*time.Second, 30*time.Second)
+	if err := set("rekey_after_time", "0"); err != nil {
+		t.Fatal(err)
+	}
+	check(20*time.Second, 30*time.Second)
+
+	for _, kv := range [][2]string{
+		{"rekey_after_time", "121"},
+		{"rekey_after_time", "5"},
+		{"reject_after_time", "181"},
+		{"reject_after_time", "99999999999999999999"},
+		{"rekey_after_messages", "1152921504606846977"},
+	} {
+		if set(kv[0], kv[1]) == nil {
+			t.Errorf("%s=%s accepted", kv[0], kv[1])
+		}
+	}
+
+	if err := set("rekey_after_bytes", "1000"); err != nil {
+		t.Fatal(err)
+	}
+	keypair := &Keypair{txBytesBase: peer.txBytes.Load()}
+	peer.txBytes.Add(999)
+	if peer.rekeyAfterBytes(keypair) {
+		t.Error("rekey before byte limit")
+	}
+	peer.txBytes.Add(1)
+	if !peer.rekeyAfterBytes(keypair) {
+		t.Error("no rekey at byte limit")
+	}
+}
+
+func TestRekeyPolicyResponder(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	dev := randDevice(t, WithClock(clock))
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	peer, err := dev.NewPeer(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiated := func() bool {
+		peer.handshake.mutex.RLock()
+		defer peer.handshake.mutex.RUnlock()
+		return peer.handshake.state == handshakeInitiationCreated
+	}
+
+	// a session the peer initiated
+	keypair := &Keypair{created: clock.Now()}
+	peer.keypairs.Lock()
+	peer.keypairs.current = keypair
+	peer.keypairs.Unlock()
+	clock.Advance(30 * time.Second)
+
+	peer.keepKeyFreshSending()
+	if initiated() {
+		t.Fatal("responder rekeyed on time without a session lifetime of its own")
+	}
+
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "rekey_after_time", "20")); err != nil {
+		t.Fatal(err)
+	}
+	peer.keepKeyFreshSending()
+	if !initiated() {
+		t.Error("responder did not rekey after rekey_after_time")
+	}
+	if got := peer.rejectAfterTime(); got != 30*time.Second {
+		t.Errorf("responded session rejected after %v, want 30s", got)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	clock := NewFakeClock(start)
+	var fired []time.Duration
+	record := func() { fired = append(fired, clock.Now().Sub(start)) }
+
+	a := clock.AfterFunc(2*time.Second, record)
+	clock.AfterFunc(time.Second, func() {
+		record()
+		a.Reset(3 * time.Second) // now due at 4s
+	})
+	b := clock.AfterFunc(5*time.Second, record)
+	clock.Advance(4 * time.Second)
+	if !b.Stop() {
+		t.Error("Stop of pending timer returned false")
+	}
+	clock.Advance(time.Hour)
+	if a.Stop() {
+		t.Error("Stop of fired timer returned true")
+	}
+
+	want := []time.Duration{time.Second, 4 * time.Second}
+	if fmt.Sprint(fired) != fmt.Sprint(want) {
+		t.Errorf("timers fired at %v, want %v", fired, want)
+	}
+	if got := clock.Now().Sub(start); got != time.Hour+4*time.Second {
+		t.Errorf("clock at %v after advancing, want %v", got, time.Hour+4*time.Second)
+	}
+}
+
+func TestFakeClockKeyExpiry(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	pair := genTestPairWithClock(t, false, clock)
+	pair.Send(t, Ping, nil)
+
+	peers := [2]*Peer{
+		pair[0].dev.LookupPeer(pair[1].dev.staticIdentity.publicKey),
+		pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey),
+	}
+	for i, peer := range peers {
+		if peer.keypairs.Current() == nil {
+			t.Fatalf("no session on device %d", i)
+		}
+	}
+
+	// pair[0] received data, so it answers with a keepalive, after which
+	// pair[1] no longer expects a reply to what it sent
+	clock.Advance(KeepaliveTimeout)
+	deadline := time.Now().Add(5 * time.Second)
+	for peers[1].timers.newHandshake.IsPending() {
+		if time.Now().After(deadline) {
+			t.Fatal("keepalive not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(RejectAfterTime * 3)
+	for i, peer := range peers {
+		if peer.keypairs.Current() != nil {
+			t.Errorf("session on device %d not zeroed", i)
+		}
+	}
+}
+
+func TestHandshakeQueuePriority(t *testing.T) {
+	q := newHandshakeQueue()
+	for i := 0; i < handshakeClassUnknown.queueSize(); i++ {
+		if !q.send(handshakeClassUnknown, QueueHandshakeElement{msgType: MessageInitiationType}) {
+			t.Fatal("initiation dropped before queue was full")
+		}
+	}
+	if q.send(handshakeClassUnknown, QueueHandshakeElement{msgType: MessageInitiationType}) {
+		t.Fatal("initiation queued beyond queue size")
+	}
+	if got := q.dropped[handshakeClassUnknown].Load(); got != 1 {
+		t.Fatalf("dropped initiations = %d, want 1", got)
+	}
+	if !q.send(handshakeClassKnown, QueueHandshakeElement{msgType: MessageInitiationType, packet: []byte{1}}) {
+		t.Fatal("known initiation dropped during flood")
+	}
+	if !q.send(handshakeClassReply, QueueHandshakeElement{msgType: MessageResponseType}) {
+		t.Fatal("response dropped during flood")
+	}
+	q.wg.Done()
+
+	if elem, _ := q.receive(); elem.msgType != MessageResponseType {
+		t.Fatal("response not received first")
+	}
+	if elem, _ := q.receive(); len(elem.packet) != 1 {
+		t.Fatal("known initiation not received second")
+	}
+	for i := 0; i < handshakeClassUnknown.queueSize(); i++ {
+		if _, ok := q.receive(); !ok {
+			t.Fatal("queue closed before drained")
+		}
+	}
+	if _, ok := q.receive(); ok {
+		t.Fatal("element received from drained queue")
+	}
+
+	clock := NewFakeClock(time.Now())
+	dev := randDevice(t, WithClock(clock))
+	defer dev.Close()
+	endpoint := &conn.StdNetEndpoint{AddrPort: netip.MustParseAddrPort("192.0.2.1:51820")}
+	if class := dev.handshakeClassOf(MessageCookieReplyType, endpoint); class != handshakeClassReply {
+		t.Errorf("cookie reply classed as %v", class)
+	}
+	if class := dev.handshakeClassOf(MessageInitiationType, endpoint); class != handshakeClassUnknown {
+		t.Errorf("initiation from new source classed as %v", class)
+	}
+	dev.noteAuthenticatedSource(endpoint)
+	if class := dev.handshakeClassOf(MessageInitiationType, endpoint); class != handshakeClassKnown {
+		t.Errorf("initiation from authenticated source classed as %v", class)
+	}
+	clock.Advance(RejectAfterTime + time.Second)
+	if class := dev.handshakeClassOf(MessageInitiationType, endpoint); class != handshakeClassUnknown {
+		t.Errorf("initiation from stale source classed as %v", class)
+	}
+}
+
+func TestBanList(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	dev := randDevice(t, WithClock(clock))
+	defer dev.Close()
+	endpoint := func(s string) conn.Endpoint {
+		return &conn.StdNetEndpoint{AddrPort: netip.MustParseAddrPort(s)}
+	}
+	offend := func(ep conn.Endpoint) {
+		for i := 0; i < 3; i++ {
+			dev.handshakeOffence(ep, HandshakeFailureAuthentication)
+		}
+	}
+	abuser := endpoint("192.0.2.1:51820")
+
+	offend(abuser)
+	if dev.handshakeSourceBanned(abuser) {
+		t.Fatal("source banned with automatic bans disabled")
+	}
+
+	dev.SetBanPolicy(BanPolicy{Threshold: 3, Duration: time.Minute, MaxDuration: 3 * time.Minute})
+	dev.handshakeOffence(abuser, HandshakeFailureAuthentication)
+	dev.handshakeOffence(abuser, HandshakeFailureUnknownPeer)
+	if dev.handshakeSourceBanned(abuser) {
+		t.Fatal("source banned below threshold")
+	}
+	dev.handshakeOffence(abuser, HandshakeFailureWrongRecipient)
+	if !dev.handshakeSourceBanned(abuser) {
+		t.Fatal("source not banned at threshold")
+	}
+	if dev.handshakeSourceBanned(endpoint("192.0.2.2:51820")) {
+		t.Fatal("other source banned")
+	}
+
+	// bans escalate, up to the maximum
+	for _, d := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		if d > time.Minute {
+			offend(abuser)
+		}
+		clock.Advance(d - time.Second)
+		if !dev.handshakeSourceBanned(abuser) {
+			t.Fatalf("ban of %v ended early", d)
+		}
+		clock.Advance(time.Second)
+		if dev.handshakeSourceBanned(abuser) {
+			t.Fatalf("ban of %v did not end", d)
+		}
+	}
+
+	// IPv6 sources are banned by /64
+	offend(endpoint("[2001:db8::1]:51820"))
+	if !dev.handshakeSourceBanned(endpoint("[2001:db8::2]:51820")) {
+		t.Fatal("neighbour of IPv6 source not banned")
+	}
+
+	// each kind of abuse arriving over the network gets its source banned
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	sock, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(dev.net.port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	local := endpoint("127.0.0.1:1")
+	expectBan := func(what string, packet []byte) {
+		t.Helper()
+		dev.Unban(netip.MustParsePrefix("127.0.0.1/32"))
+		for i := 0; i < 3; i++ {
+			if _, err := sock.Write(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for deadline := time.Now().Add(5 * time.Second); !dev.handshakeSourceBanned(local); {
+			if time.Now().After(deadline) {
+				t.Errorf("source not banned for %s", what)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	malformed := make([]byte, MessageInitiationSize-1)
+	binary.LittleEndian.PutUint32(malformed, MessageInitiationType)
+	expectBan("malformed initiations", malformed)
+	unknownType := make([]byte, MessageInitiationSize)
+	binary.LittleEndian.PutUint32(unknownType, 5)
+	expectBan("messages of unknown type", unknownType)
+	badMAC1 := make([]byte, MessageInitiationSize)
+	binary.LittleEndian.PutUint32(badMAC1, MessageInitiationType)
+	expectBan("initiations with invalid mac1", badMAC1)
+	var generator CookieGenerator
+	generator.Init(dev.staticIdentity.publicKey)
+	noMAC2 := make([]byte, MessageInitiationSize)
+	binary.LittleEndian.PutUint32(noMAC2, MessageInitiationType)
+	generator.AddMacs(noMAC2)
+	dev.SetLoadPolicy(LoadPolicy{Mode: LoadModeOn})
+	expectBan("ignoring cookies under load", noMAC2)
+	dev.SetLoadPolicy(LoadPolicy{})
+	dev.Unban(netip.MustParsePrefix("127.0.0.1/32"))
+
+	// manual bans
+	if err := dev.IpcSet("ban=198.51.100.0/24\nban=203.0.113.5,30\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.handshakeSourceBanned(endpoint("198.51.100.7:51820")) {
+		t.Fatal("source in banned prefix not banned")
+	}
+	config, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"ban_threshold=3", "ban=198.51.100.0/24", "ban=203.0.113.5/32,30", "ban=2001:db8::/64,60"} {
+		if !strings.Contains(config, line+"\n") {
+			t.Errorf("UAPI get is missing %q", line)
+		}
+	}
+	if err := dev.IpcSet("unban=198.51.100.0/24\n"); err != nil {
+		t.Fatal(err)
+	}
+	if dev.handshakeSourceBanned(endpoint("198.51.100.7:51820")) {
+		t.Fatal("source banned after unban")
+	}
+}
+
+type denyingHandshakeLimiter struct {
+	calls atomic.Int32
+}
+
+func (l *denyingHandshakeLimiter) Allow(ip netip.Addr) bool {
+	l.calls.Add(1)
+	return false
+}
+
+func TestHandshakeLimiter(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	if err := dev.IpcSet("handshake_rate=2\nhandshake_burst=3\nhandshake_rate_ipv6_prefix=64\nhandshake_rate_exempt=10.0.0.0/8,fd00::/8\n"); err != nil {
+		t.Fatal(err)
+	}
+	config := dev.rate.limiter.Config()
+	if config.PacketsPerSecond != 2 || config.PacketsBurstable != 3 || config.IPv6PrefixLength != 64 || len(config.Exempt) != 2 {
+		t.Fatalf("rate limit not configured: %+v", config)
+	}
+	uapi, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"handshake_rate=2", "handshake_burst=3", "handshake_rate_ipv6_prefix=64", "handshake_rate_exempt=10.0.0.0/8,fd00::/8"} {
+		if !strings.Contains(uapi, line+"\n") {
+			t.Errorf("UAPI get is missing %q", line)
+		}
+	}
+	if err := dev.IpcSet("handshake_rate=1000000001\n"); err == nil {
+		t.Error("handshake rate too fast to cost any tokens accepted")
+	}
+	if err := dev.IpcSet("handshake_rate_ipv6_prefix=129\n"); err == nil {
+		t.Error("invalid IPv6 prefix length accepted")
+	}
+
+	if !dev.allowHandshake(netip.MustParseAddr("10.1.2.3")) {
+		t.Fatal("exempt source limited")
+	}
+	limiter := new(denyingHandshakeLimiter)
+	dev.SetHandshakeLimiter(limiter)
+	if dev.allowHandshake(netip.MustParseAddr("10.1.2.3")) || limiter.calls.Load() != 1 {
+		t.Fatal("custom limiter not used")
+	}
+	dev.SetHandshakeLimiter(nil)
+	if !dev.allowHandshake(netip.MustParseAddr("10.1.2.3")) || limiter.calls.Load() != 1 {
+		t.Fatal("built-in limiter not restored")
+	}
+}
+
+func TestLoadMode(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	dev := randDevice(t, WithClock(clock))
+	defer dev.Close()
+	var events []bool
+	dev.SetLoadHandler(func(underLoad bool) {
+		events = append(events, underLoad)
+	})
+	expectEvents := func(want ...bool) {
+		t.Helper()
+		if fmt.Sprint(events) != fmt.Sprint(want) {
+			t.Fatalf("load events %v, want %v", events, want)
+		}
+	}
+
+	if dev.IsUnderLoad() {
+		t.Fatal("idle device under load")
+	}
+	if err := dev.IpcSet("load_mode=on\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.IsUnderLoad() {
+		t.Fatal("device not under load with load mode on")
+	}
+	expectEvents(true)
+	config, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config, "load_mode=on\n") {
+		t.Error("UAPI get is missing load mode")
+	}
+	dev.SetLoadPolicy(LoadPolicy{Mode: LoadModeOff})
+	if dev.IsUnderLoad() {
+		t.Fatal("device under load with load mode off")
+	}
+	expectEvents(true, false)
+
+	// in auto mode, the device leaves load mode once the hold time has passed
+	dev.SetLoadPolicy(LoadPolicy{HoldTime: 2 * time.Second})
+	dev.rate.underLoadUntil.Store(clock.Now().Add(2 * time.Second).UnixNano())
+	dev.load.Lock()
+	dev.setUnderLoadLocked(true)
+	dev.load.Unlock()
+	clock.Advance(time.Second)
+	if !dev.IsUnderLoad() {
+		t.Fatal("device left load mode before hold time")
+	}
+	expectEvents(true, false, true)
+	clock.Advance(time.Second)
+	if dev.IsUnderLoad() {
+		t.Fatal("device still under load after hold time")
+	}
+	expectEvents(true, false, true, false)
+}
+
+func TestSharedBind(t *testing.T) {
+	goroutineLeakCheck(t)
+	shared := NewSharedBind(conn.NewDefaultBind())
+	var hubs, remotes [2]testPeer
+	var hubKeys, remoteKeys [2]NoisePrivateKey
+	for i := range hubs {
+		if _, err := rand.Read(hubKeys[i][:]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rand.Read(remoteKeys[i][:]); err != nil {
+			t.Fatal(err)
+		}
+		hubs[i].tun = tuntest.NewChannelTUN()
+		hubs[i].ip = netip.MustParseAddr("1.0.0.1")
+		hubs[i].dev = NewDevice(hubs[i].tun.TUN(), shared.NewBind(), NewLogger(LogLevelVerbose, fmt.Sprintf("hub%d: ", i)))
+		t.Cleanup(hubs[i].dev.Close)
+		remotes[i].tun = tuntest.NewChannelTUN()
+		remotes[i].ip = netip.MustParseAddr("1.0.0.2")
+		remotes[i].dev = NewDevice(remotes[i].tun.TUN(), conn.NewDefaultBind(), NewLogger(LogLevelVerbose, fmt.Sprintf("remote%d: ", i)))
+		t.Cleanup(remotes[i].dev.Close)
+	}
+	for i := range hubs {
+		pub := remoteKeys[i].publicKey()
+		if err := hubs[i].dev.IpcSet(uapiCfg(
+			"private_key", hex.EncodeToString(hubKeys[i][:]),
+			"listen_port", "0",
+			"public_key", hex.EncodeToString(pub[:]),
+			"allowed_ip", "1.0.0.2/32",
+		)); err != nil {
+			t.Fatal(err)
+		}
+		if err := hubs[i].dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hubs[0].dev.net.port != hubs[1].dev.net.port {
+		t.Fatalf("devices listening on ports %d and %d", hubs[0].dev.net.port, hubs[1].dev.net.port)
+	}
+	for i := range remotes {
+		pub := hubKeys[i].publicKey()
+		if err := remotes[i].dev.IpcSet(uapiCfg(
+			"private_key", hex.EncodeToString(remoteKeys[i][:]),
+			"listen_port", "0",
+			"public_key", hex.EncodeToString(pub[:]),
+			"allowed_ip", "1.0.0.1/32",
+			"endpoint", fmt.Sprintf("127.0.0.1:%d", hubs[i].dev.net.port),
+		)); err != nil {
+			t.Fatal(err)
+		}
+		if err := remotes[i].dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range hubs {
+		pair := testPair{hubs[i], remotes[i]}
+		pair.Send(t, Ping, nil)
+		pair.Send(t, Pong, nil)
+	}
+
+	// a closed device is no longer dispatched to, and the others carry on
+	hubs[0].dev.Close()
+	if open := shared.openConns(); len(open.conns) != 1 || open.byDevice[hubs[1].dev] == nil {
+		t.Fatalf("%d devices open after closing one, want the other one", len(open.conns))
+	}
+	pair := testPair{hubs[1], remotes[1]}
+	pair.Send(t, Ping, nil)
+}
+
+func TestMessageHandler(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	const msgType = MinCustomMessageType + 1
+	if err := pair[1].dev.SetMessageHandler(MessageTransportType, func([]byte, conn.Endpoint) {}); err == nil {
+		t.Error("handler set for transport messages")
+	}
+	received := make(chan []byte, 1)
+	if err := pair[1].dev.SetMessageHandler(msgType, func(msg []byte, endpoint conn.Endpoint) {
+		received <- bytes.Clone(msg)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, err := pair[0].dev.net.bind.ParseEndpoint(fmt.Sprintf("127.0.0.1:%d", pair[1].dev.net.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pair[0].dev.SendRaw(endpoint, []byte{MessageInitiationType, 0, 0, 0}); err == nil {
+		t.Error("message of reserved type sent")
+	}
+	msg := []byte{msgType, 0, 0, 0, 'h', 'i'}
+	if err := pair[0].dev.SendRaw(endpoint, msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, msg) {
+			t.Errorf("received %x, want %x", got, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	// WireGuard traffic is unaffected.
+	pair.Send(t, Ping, nil)
+}
+
+func TestProbe(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	endpoint, err := pair[0].dev.net.bind.ParseEndpoint(fmt.Sprintf("127.0.0.1:%d", pair[1].dev.net.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := pair[1].dev.staticIdentity.publicKey
+	ctx := context.Background()
+
+	if _, err := pair[0].dev.Probe(ctx, pk, NoisePresharedKey{}, endpoint); err != nil {
+		t.Errorf("probe failed: %v", err)
+	}
+	time.Sleep(HandshakeInitationRate) // not to be taken for a flood
+	if _, err := pair[0].dev.Probe(ctx, pk, NoisePresharedKey{1}, endpoint); err != ProbeInvalidResponse {
+		t.Errorf("probe with wrong preshared key: %v, want %v", err, ProbeInvalidResponse)
+	}
+	var unknown NoisePublicKey
+	unknown[0] = 9
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := pair[0].dev.Probe(timeoutCtx, unknown, NoisePresharedKey{}, endpoint); err != ProbeTimeout {
+		t.Errorf("probe of unknown key: %v, want %v", err, ProbeTimeout)
+	}
+	pair[1].dev.SetLoadPolicy(LoadPolicy{Mode: LoadModeOn})
+	if _, err := pair[0].dev.Probe(ctx, pk, NoisePresharedKey{}, endpoint); err != ProbeCookieDemanded {
+		t.Errorf("probe of loaded device: %v, want %v", err, ProbeCookieDemanded)
+	}
+
+	// Probes do not add peers or sessions.
+	pair[0].dev.peers.RLock()
+	peers := len(pair[0].dev.peers.keyMap)
+	pair[0].dev.peers.RUnlock()
+	if peers != 1 {
+		t.Errorf("device has %d peers after probing, want 1", peers)
+	}
+}
+
+func TestPathQuality(t *testing.T) {
+	var e pathEstimator
+	now := time.Now()
+	e.addRTT(100*time.Millisecond, now)
+	if e.RTT != 100*time.Millisecond || e.RTTVar != 50*time.Millisecond {
+		t.Errorf("first sample gave rtt %v, var %v", e.RTT, e.RTTVar)
+	}
+	e.addRTT(20*time.Millisecond, now)
+	if e.RTT != 90*time.Millisecond || e.RTTVar != 57500*time.Microsecond {
+		t.Errorf("second sample gave rtt %v, var %v", e.RTT, e.RTTVar)
+	}
+	e.addLoss(now)
+	if e.Loss != 0.125 {
+		t.Errorf("loss after one unanswered initiation = %v, want 0.125", e.Loss)
+	}
+
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	pair.Send(t, Ping, nil)
+	peer := pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey)
+	total, endpoints := peer.PathQuality()
+	if total.Samples != 1 || total.RTT <= 0 {
+		t.Fatalf("initiator measured %d samples, rtt %v", total.Samples, total.RTT)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", pair[0].dev.net.port)
+	if q, ok := endpoints[addr]; !ok || q != total {
+		t.Errorf("path quality of %s = %+v, want %+v", addr, q, total)
+	}
+	cfg, err := pair[1].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "path=" + formatPathQuality(addr, total) + "\n"; !strings.Contains(cfg, want) {
+		t.Errorf("UAPI get lacks %q", want)
+	}
+
+	// Loss is charged to the endpoints the initiation went to, not the
+	// current endpoint.
+	direct, candidate := "192.0.2.1:51820", "192.0.2.2:51820"
+	var sentTo []conn.Endpoint
+	for _, s := range []string{direct, candidate} {
+		ep, err := pair[1].dev.net.bind.ParseEndpoint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sentTo = append(sentTo, ep)
+	}
+	peer.notePathInitiation(sentTo)
+	peer.notePathLoss()
+	peer.notePathLoss()
+	_, endpoints = peer.PathQuality()
+	for _, s := range []string{direct, candidate} {
+		if loss := endpoints[s].Loss; loss != 0.125 {
+			t.Errorf("loss of %s = %v, want 0.125", s, loss)
+		}
+	}
+	if loss := endpoints[addr].Loss; loss != total.Loss {
+		t.Errorf("loss charged to %s, which the initiation was not sent to", addr)
+	}
+}
+
+func TestAdaptiveKeepalive(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	dev := randDevice(t, WithClock(clock))
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"persistent_keepalive_adaptive", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+	if got := peer.keepaliveInterval(); got != AdaptiveKeepaliveInitial {
+		t.Fatalf("initial interval = %v, want %v", got, AdaptiveKeepaliveInitial)
+	}
+
+	passIntervals := func(n int) {
+		for range n {
+			peer.keepaliveIntervalPassed()
+		}
+	}
+	passIntervals(AdaptiveKeepaliveCycles)
+	if got := peer.keepaliveInterval(); got != 2*AdaptiveKeepaliveInitial {
+		t.Fatalf("interval after %d quiet intervals = %v, want %v", AdaptiveKeepaliveCycles, got, 2*AdaptiveKeepaliveInitial)
+	}
+
+	// A packet from the peer after a minute of silence shows that the
+	// mapping lasts at least that long. Our own packets show nothing.
+	peer.timersAnyAuthenticatedPacketReceived()
+	clock.Advance(time.Minute)
+	peer.timersAnyAuthenticatedPacketReceived()
+	peer.timersAnyAuthenticatedPacketSent()
+	passIntervals(AdaptiveKeepaliveCycles)
+	if got := peer.keepaliveInterval(); got != 4*AdaptiveKeepaliveInitial {
+		t.Fatalf("interval after %d more quiet intervals = %v, want %v", AdaptiveKeepaliveCycles, got, 4*AdaptiveKeepaliveInitial)
+	}
+
+	// An initiation long after our last keepalive is a rekey, not the peer
+	// getting through again.
+	clock.Advance(time.Minute)
+	peer.keepaliveCheckInitiation()
+	if got := peer.keepaliveInterval(); got != 4*AdaptiveKeepaliveInitial {
+		t.Fatalf("interval changed by initiation unrelated to keepalive: %v", got)
+	}
+
+	// As is one right after it, if we have been hearing from the peer.
+	peer.timersAnyAuthenticatedPacketReceived()
+	passIntervals(1)
+	clock.Advance(time.Second)
+	peer.keepaliveCheckInitiation()
+	if got := peer.keepaliveInterval(); got != 4*AdaptiveKeepaliveInitial {
+		t.Fatalf("interval changed by initiation while hearing from peer: %v", got)
+	}
+
+	// An initiation right after our keepalive, following a silence of more
+	// than half the interval, means the peer could not reach us. This holds
+	// however old the session is.
+	clock.Advance(4 * AdaptiveKeepaliveInitial)
+	passIntervals(1)
+	clock.Advance(time.Second)
+	peer.keepaliveCheckInitiation()
+	if got := peer.keepaliveInterval(); got != time.Minute {
+		t.Fatalf("interval after mapping expired = %v, want %v", got, time.Minute)
+	}
+	passIntervals(2 * AdaptiveKeepaliveCycles)
+	if got := peer.keepaliveInterval(); got != time.Minute {
+		t.Fatalf("settled interval grew to %v", got)
+	}
+
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"persistent_keepalive_interval=0\n", "persistent_keepalive_adaptive=true\n", "persistent_keepalive_adaptive_interval=60\n", "persistent_keepalive_settled=true\n"} {
+		if !strings.Contains(cfg, want) {
+			t.Errorf("UAPI get lacks %q", want)
+		}
+	}
+
+	// After a while, a longer interval is tried again.
+	clock.Advance(AdaptiveKeepaliveResettle)
+	passIntervals(AdaptiveKeepaliveCycles)
+	if got := peer.keepaliveInterval(); got != 2*time.Minute {
+		t.Fatalf("interval after settling for %v = %v, want %v", AdaptiveKeepaliveResettle, got, 2*time.Minute)
+	}
+
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"persistent_keepalive_adaptive", "false",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if got := peer.keepaliveInterval(); got != 0 {
+		t.Errorf("interval with adaptive mode off = %v, want 0", got)
+	}
+}
+
+func TestHandshakeBackoff(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	dev := randDevice(t, WithClock(clock))
+	defer dev.Close()
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	if err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"handshake_backoff_max", "60",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+	for i, want := range []time.Duration{5, 10, 20, 40, 60, 60} {
+		if got := peer.nextHandshakeRetryDelay(); got != want*time.Second {
+			t.Errorf("delay after %d unanswered initiations = %v, want %v", i, got, want*time.Second)
+		}
+		peer.backoff.failures.Add(1)
+	}
+
+	// Staged packets do not cut the wait short.
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = clock.Now()
+	peer.handshake.mutex.Unlock()
+	clock.Advance(RekeyTimeout * 2)
+	peer.timers.handshakeAttempts.Store(3)
+	peer.SendHandshakeInitiation(false)
+	peer.handshake.mutex.RLock()
+	state := peer.handshake.state
+	peer.handshake.mutex.RUnlock()
+	if state != handshakeZeroed {
+		t.Error("initiation sent before backoff delay passed")
+	}
+	if attempts := peer.timers.handshakeAttempts.Load(); attempts != 3 {
+		t.Errorf("staged packets reset handshake attempts to %d during backoff", attempts)
+	}
+	peer.timersHandshakeComplete()
+	if got := peer.handshakeRetryDelay(); got != RekeyTimeout {
+		t.Errorf("delay after complete handshake = %v, want %v", got, RekeyTimeout)
+	}
+
+	cfg, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg, "handshake_backoff_max=60\n") {
+		t.Error("UAPI get lacks handshake_backoff_max")
+	}
+}
+
+func TestPassivePeer(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	pk := pair[0].dev.staticIdentity.publicKey
+	if err := pair[1].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"passive", "true",
+	)); err != nil {
+		t.Fatal(err)
+	}
+	peer := pair[1].dev.LookupPeer(pk)
+	peer.SendHandshakeInitiation(false)
+	peer.handshake.mutex.RLock()
+	state := peer.handshake.state
+	peer.handshake.mutex.RUnlock()
+	if state != handshakeZeroed {
+		t.Fatal("passive peer sent initiation")
+	}
+
+	// The passive side still responds.
+	pair.Send(t, Pong, nil)
+	pair.Send(t, Ping, nil)
+}
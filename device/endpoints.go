@@ -0,0 +1,208 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	MaxEndpointCandidates    = 8                      // maximum number of configured endpoints per peer
+	EndpointFailoverAttempts = 2                      // unanswered handshake retries before trying the next endpoint
+	EndpointAttemptDelay     = time.Millisecond * 250 // time between initiations to successive candidates, as in RFC 8305
+)
+
+// setEndpointCandidatesLocked replaces the peer's candidate endpoints, making the
+// first of them current. The caller must hold peer.endpoint.
+func (peer *Peer) setEndpointCandidatesLocked(candidates []conn.Endpoint) {
+	peer.endpoint.candidates = candidates
+	peer.endpoint.val = nil
+	if len(candidates) > 0 {
+		peer.endpoint.val = candidates[0]
+	}
+	peer.endpoint.learned = false
+	peer.endpoint.clearSrcOnTx = false
+	peer.endpoint.viaRelay = false
+	peer.endpoint.roamPending = nil
+}
+
+// failOverEndpoint moves the peer on to its next candidate endpoint, or, if
+// it has roamed away from several candidates or from endpoint names, back to
+// the first of them. A peer with a single literal endpoint stays where it
+// was last heard from, as does one that may not roam. With
+// roaming=same_family, only candidates of the same address family are
+// tried.
+func (peer *Peer) failOverEndpoint() {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	candidates := peer.endpoint.candidates
+	current := peer.endpoint.val
+	if len(candidates) == 0 || current == nil || peer.endpoint.disableRoaming || peer.endpoint.roaming == roamingOff {
+		return
+	}
+	index := slices.IndexFunc(candidates, func(candidate conn.Endpoint) bool {
+		return sameEndpoint(candidate, current)
+	})
+	if index < 0 && (!peer.endpoint.learned || len(candidates) < 2 && len(peer.endpoint.names) == 0) {
+		return
+	}
+	for i := 1; i <= len(candidates); i++ {
+		next := (index + i) % len(candidates)
+		if next == index {
+			break
+		}
+		if peer.endpoint.roaming == roamingSameFamily && candidates[next].DstIP().Unmap().Is4() != current.DstIP().Unmap().Is4() {
+			continue
+		}
+		peer.endpoint.val = candidates[next]
+		peer.endpoint.learned = false
+		peer.endpoint.clearSrcOnTx = true
+		peer.device.log.Verbosef("%v - Failing over to endpoint %s", peer, peer.endpoint.val.DstToString())
+		return
+	}
+}
+
+// sendInitiationToAlternatives sends a handshake initiation, which has
+// already been sent by SendBuffers, along the paths that SendBuffers did not
+// take: at once to the direct endpoint if the peer is relayed, and, on
+// retries, to every other candidate endpoint in turn, EndpointAttemptDelay
+// apart, for as long as the initiation goes unanswered. The responder
+// accepts whichever copy arrives first, rejects the rest as replays, and
+// replies to the address it came from, at which point SetEndpointFromPacket
+// adopts it, so the candidates race and the fastest working path wins. It
+// returns the endpoints the initiation was sent to at once.
+func (peer *Peer) sendInitiationToAlternatives(packet []byte, isRetry bool) (sentTo []conn.Endpoint) {
+	var direct conn.Endpoint
+	var others []conn.Endpoint
+
+	peer.endpoint.Lock()
+	val := peer.endpoint.val
+	if peer.endpoint.viaRelay && val != nil {
+		direct = val
+	}
+	if isRetry {
+		for _, candidate := range peer.endpoint.candidates {
+			if candidate != val {
+				others = append(others, candidate)
+			}
+		}
+	}
+	peer.endpoint.Unlock()
+
+	if len(others) > 0 {
+		sender := binary.LittleEndian.Uint32(packet[4:8])
+		peer.sendInitiationStaggered(packet, sender, others)
+	}
+	if direct == nil || !peer.sendInitiationTo(packet, direct) {
+		return nil
+	}
+	return []conn.Endpoint{direct}
+}
+
+// sendInitiationStaggered sends the handshake initiation packet, with sender
+// index sender, to each of endpoints after another EndpointAttemptDelay,
+// stopping once the handshake is answered or superseded. Each endpoint is
+// added to those that loss is charged to as it is tried.
+func (peer *Peer) sendInitiationStaggered(packet []byte, sender uint32, endpoints []conn.Endpoint) {
+	var next func()
+	next = func() {
+		handshake := &peer.handshake
+		handshake.mutex.RLock()
+		pending := handshake.state == handshakeInitiationCreated && handshake.localIndex == sender
+		handshake.mutex.RUnlock()
+		if !pending || !peer.isRunning.Load() {
+			return
+		}
+		endpoint := endpoints[0]
+		endpoints = endpoints[1:]
+		if peer.sendInitiationTo(packet, endpoint) {
+			peer.path.Lock()
+			peer.path.sentTo = append(peer.path.sentTo, endpoint)
+			peer.path.Unlock()
+		}
+		if len(endpoints) > 0 {
+			peer.device.clock.AfterFunc(EndpointAttemptDelay, next)
+		}
+	}
+	peer.device.clock.AfterFunc(EndpointAttemptDelay, next)
+}
+
+// sendInitiationTo sends the handshake initiation packet to endpoint,
+// reporting whether it was sent.
+func (peer *Peer) sendInitiationTo(packet []byte, endpoint conn.Endpoint) bool {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+	if err := peer.device.net.bind.Send([][]byte{packet}, endpoint); err != nil {
+		peer.device.log.Verbosef("%v - Failed to send handshake initiation to %s: %v", peer, endpoint.DstToString(), err)
+		return false
+	}
+	return true
+}
+
+// endpointAllowed reports whether the peer may be reached at endpoint, that
+// is, whether endpoint is within the networks listed with
+// endpoint_allowed_ips, if any. Handshake messages from elsewhere are dropped
+// before they touch the handshake state, even though they authenticate, and
+// data from elsewhere is still delivered, being authenticated, but does not
+// make the peer roam. Either way, the peer's rejectedEndpoints counter goes
+// up.
+func (peer *Peer) endpointAllowed(endpoint conn.Endpoint) bool {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	return peer.endpointAllowedLocked(endpoint)
+}
+
+// endpointAllowedLocked is like endpointAllowed. The caller must hold
+// peer.endpoint.
+func (peer *Peer) endpointAllowedLocked(endpoint conn.Endpoint) bool {
+	if len(peer.endpoint.allowedIPs) == 0 {
+		return true
+	}
+	ip := endpoint.DstIP().Unmap()
+	for _, prefix := range peer.endpoint.allowedIPs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	peer.rejectedEndpoints.Add(1)
+	return false
+}
+
+// parsePrefixList parses a comma-separated list of prefixes, as used by
+// UAPI keys such as endpoint_allowed_ips, where an empty list allows any
+// endpoint.
+func parsePrefixList(value string) ([]netip.Prefix, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(value, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func formatPrefixList(prefixes []netip.Prefix) string {
+	var b strings.Builder
+	for i, prefix := range prefixes {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprint(&b, prefix)
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A HandshakeFailure is the reason a handshake message was rejected.
+// Failures are logged, and counted per peer, or per device when the peer
+// is not known; UAPI reports each non-zero count as
+// handshake_failure_<reason>_count, where <reason> is its String.
+type HandshakeFailure int
+
+const (
+	HandshakeFailureMalformed          HandshakeFailure = iota + 1 // message of the wrong type
+	HandshakeFailureInvalidMAC1                                    // mac1 not keyed to our public key
+	HandshakeFailureMissingMAC2                                    // no valid mac2 while under load
+	HandshakeFailureInvalidKey                                     // ephemeral key unusable, or no private key set
+	HandshakeFailureWrongRecipient                                 // initiation not encrypted to our public key
+	HandshakeFailureUnknownPeer                                    // initiator's public key is not configured
+	HandshakeFailurePeerStopped                                    // peer is configured but not running
+	HandshakeFailureAuthentication                                 // peer's keys or preshared key do not match
+	HandshakeFailureReplay                                         // timestamp not newer than the last one
+	HandshakeFailureFlood                                          // initiations arriving too fast
+	HandshakeFailureEndpointNotAllowed                             // source outside endpoint_allowed_ips
+	HandshakeFailureUnknownIndex                                   // response to no initiation of ours
+	HandshakeFailureWrongState                                     // response to an initiation already answered
+	numHandshakeFailures
+)
+
+var handshakeFailureNames = [numHandshakeFailures]string{
+	HandshakeFailureMalformed:          "malformed",
+	HandshakeFailureInvalidMAC1:        "invalid_mac1",
+	HandshakeFailureMissingMAC2:        "missing_mac2",
+	HandshakeFailureInvalidKey:         "invalid_key",
+	HandshakeFailureWrongRecipient:     "wrong_recipient",
+	HandshakeFailureUnknownPeer:        "unknown_peer",
+	HandshakeFailurePeerStopped:        "peer_stopped",
+	HandshakeFailureAuthentication:     "authentication",
+	HandshakeFailureReplay:             "replay",
+	HandshakeFailureFlood:              "flood",
+	HandshakeFailureEndpointNotAllowed: "endpoint_not_allowed",
+	HandshakeFailureUnknownIndex:       "unknown_index",
+	HandshakeFailureWrongState:         "wrong_state",
+}
+
+var handshakeFailureErrors = [numHandshakeFailures]string{
+	HandshakeFailureMalformed:          "malformed message",
+	HandshakeFailureInvalidMAC1:        "invalid mac1, sender has the wrong public key for us",
+	HandshakeFailureMissingMAC2:        "no valid mac2 under load, answered with a cookie",
+	HandshakeFailureInvalidKey:         "invalid ephemeral key or no private key",
+	HandshakeFailureWrongRecipient:     "not addressed to our public key",
+	HandshakeFailureUnknownPeer:        "unknown peer",
+	HandshakeFailurePeerStopped:        "peer not running",
+	HandshakeFailureAuthentication:     "authentication failed, keys or preshared key mismatched",
+	HandshakeFailureReplay:             "timestamp not newer than last seen, replayed or initiator clock went backwards",
+	HandshakeFailureFlood:              "initiations too frequent",
+	HandshakeFailureEndpointNotAllowed: "endpoint not allowed",
+	HandshakeFailureUnknownIndex:       "no handshake with receiver index",
+	HandshakeFailureWrongState:         "not awaiting a response",
+}
+
+func (failure HandshakeFailure) valid() bool {
+	return failure > 0 && failure < numHandshakeFailures
+}
+
+func (failure HandshakeFailure) String() string {
+	if !failure.valid() {
+		return fmt.Sprintf("HandshakeFailure(%d)", int(failure))
+	}
+	return handshakeFailureNames[failure]
+}
+
+func (failure HandshakeFailure) Error() string {
+	if !failure.valid() {
+		return failure.String()
+	}
+	return handshakeFailureErrors[failure]
+}
+
+// handshakeFailed logs and counts the rejection of a handshake message of
+// kind from endpoint. peer is nil if it could not be determined.
+func (device *Device) handshakeFailed(peer *Peer, failure HandshakeFailure, kind string, endpoint conn.Endpoint) {
+	if peer != nil {
+		peer.handshakeFailures[failure].Add(1)
+		device.log.Verbosef("%v - Received invalid %s message from %s: %v", peer, kind, endpoint.DstToString(), failure)
+		return
+	}
+	device.handshakeFailures[failure].Add(1)
+	device.log.Verbosef("Received invalid %s message from %s: %v", kind, endpoint.DstToString(), failure)
+}
+
+// handshakeInvalidMAC1 counts elem, an initiation or response whose mac1
+// is not keyed to any public key of ours, against the peer whose initiation
+// it responds to, if any, and otherwise against the device, logging its
+// source address.
+func (device *Device) handshakeInvalidMAC1(elem *QueueHandshakeElement) {
+	var peer *Peer
+	kind := "initiation"
+	if elem.msgType == MessageResponseType {
+		kind = "response"
+		var msg MessageResponse
+		if msg.unmarshal(elem.packet) == nil {
+			peer = device.indexTable.Lookup(msg.Receiver).peer
+		}
+	}
+	device.handshakeFailed(peer, HandshakeFailureInvalidMAC1, kind, elem.endpoint)
+}
+
+// sendHandshakeFailures reports the non-zero counts for UAPI get.
+func sendHandshakeFailures(sendf func(format string, args ...any), counts *[numHandshakeFailures]atomic.Uint64) {
+	for failure := HandshakeFailure(1); failure < numHandshakeFailures; failure++ {
+		if n := counts[failure].Load(); n != 0 {
+			sendf("handshake_failure_%s_count=%d", failure.String(), n)
+		}
+	}
+}
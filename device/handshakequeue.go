@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A handshakeClass selects which of several queues a handshake message
+// waits in for the handshake workers, so that a flood of initiations, which
+// anyone can send, does not crowd out the responses and cookie replies to
+// our own initiations, nor initiations from where our peers have recently
+// been. Each queue drops messages when full, counting them, and workers
+// take messages from the highest priority queue that has any.
+type handshakeClass int
+
+const (
+	handshakeClassReply   handshakeClass = iota // responses and cookie replies
+	handshakeClassKnown                         // initiations from recently authenticated sources
+	handshakeClassUnknown                       // other initiations
+	numHandshakeClasses
+)
+
+func (class handshakeClass) String() string {
+	switch class {
+	case handshakeClassReply:
+		return "reply"
+	case handshakeClassKnown:
+		return "known_initiation"
+	case handshakeClassUnknown:
+		return "initiation"
+	}
+	return "unknown"
+}
+
+// queueSize splits QueueHandshakeSize between the classes.
+func (class handshakeClass) queueSize() int {
+	if class == handshakeClassUnknown {
+		return QueueHandshakeSize / 2
+	}
+	return QueueHandshakeSize / 4
+}
+
+// authenticatedSources holds when a handshake with a peer at each source
+// address last completed. A source counts as recent for RejectAfterTime
+// afterwards, the life of a session made from there.
+type authenticatedSources struct {
+	sync.RWMutex
+	last      map[netip.Addr]int64 // unix nanoseconds
+	lastPrune int64
+}
+
+// noteAuthenticatedSource records that a handshake message from endpoint
+// was authenticated. It is called only on handshake completion, never for
+// transport data, so the write lock is taken at handshake rates.
+func (device *Device) noteAuthenticatedSource(endpoint conn.Endpoint) {
+	if endpoint == nil {
+		return
+	}
+	sources := &device.authenticatedSources
+	now := device.now().UnixNano()
+	sources.Lock()
+	defer sources.Unlock()
+	if sources.last == nil {
+		sources.last = make(map[netip.Addr]int64)
+	}
+	sources.last[endpoint.DstIP()] = now
+	if now-sources.lastPrune > int64(RejectAfterTime) {
+		for addr, last := range sources.last {
+			if now-last > int64(RejectAfterTime) {
+				delete(sources.last, addr)
+			}
+		}
+		sources.lastPrune = now
+	}
+}
+
+func (device *Device) recentlyAuthenticated(endpoint conn.Endpoint) bool {
+	sources := &device.authenticatedSources
+	sources.RLock()
+	last, ok := sources.last[endpoint.DstIP()]
+	sources.RUnlock()
+	return ok && device.now().UnixNano()-last <= int64(RejectAfterTime)
+}
+
+// handshakeClassOf returns the class of a handshake message of msgType
+// from endpoint.
+func (device *Device) handshakeClassOf(msgType uint32, endpoint conn.Endpoint) handshakeClass {
+	if msgType != MessageInitiationType {
+		return handshakeClassReply
+	}
+	if device.recentlyAuthenticated(endpoint) {
+		return handshakeClassKnown
+	}
+	return handshakeClassUnknown
+}
@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+// A retiringIdentity is the previous identity of a device during the
+// transition period of RotatePrivateKey. SetPrivateKey switches identity at
+// once, so every peer has to handshake again before traffic flows, and peers
+// which have not yet learned the new public key cannot reach the device at
+// all. During a rotation, current sessions are instead left alone, and
+// initiations whose mac1 is keyed to the old public key are answered as the
+// old identity, while the device itself only initiates as the new one. When
+// the period ends, the old key is forgotten.
+type retiringIdentity struct {
+	key           StaticKey
+	publicKey     NoisePublicKey
+	cookieChecker CookieChecker
+	timer         ClockTimer
+}
+
+func newRetiringIdentity(key StaticKey, pk NoisePublicKey) *retiringIdentity {
+	identity := &retiringIdentity{
+		key:       key,
+		publicKey: pk,
+	}
+	identity.cookieChecker.Init(pk)
+	return identity
+}
+
+func (identity *retiringIdentity) clear() {
+	if identity.timer != nil {
+		identity.timer.Stop()
+	}
+	if software, ok := identity.key.(*SoftwareStaticKey); ok {
+		software.clear()
+	}
+	identity.key = nil
+}
+
+// RotatePrivateKey replaces the private key of the device like
+// SetPrivateKey, but keeps accepting handshake initiations addressed to the
+// old key for the transition duration, without expiring current sessions.
+// Rotating again during a transition retires the oldest key at once.
+func (device *Device) RotatePrivateKey(sk NoisePrivateKey, transition time.Duration) error {
+	return device.setStaticKey(NewSoftwareStaticKey(sk), transition)
+}
+
+// RotateStaticKey is like RotatePrivateKey, for a key held elsewhere.
+func (device *Device) RotateStaticKey(key StaticKey, transition time.Duration) error {
+	return device.setStaticKey(key, transition)
+}
+
+// retirePrivateKey ends the transition period of identity, unless it has
+// already been replaced.
+func (device *Device) retirePrivateKey(identity *retiringIdentity) {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	if device.staticIdentity.retiring != identity {
+		return
+	}
+	device.staticIdentity.retiring = nil
+	identity.clear()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.handshake.mutex.Lock()
+		setZero(peer.handshake.retiringStaticStatic[:])
+		peer.handshake.mutex.Unlock()
+	}
+	device.log.Verbosef("Retired previous private key")
+}
+
+// retiringCookieChecker returns the cookie checker of the retiring identity,
+// if there is one and a packet of msgType may be addressed to it.
+func (device *Device) retiringCookieChecker(msgType uint32) *CookieChecker {
+	if msgType != MessageInitiationType {
+		return nil
+	}
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+	if device.staticIdentity.retiring == nil {
+		return nil
+	}
+	return &device.staticIdentity.retiring.cookieChecker
+}
+
+// checkMAC1 reports whether msg has a valid MAC1 for the current or retiring
+// identity.
+func (device *Device) checkMAC1(msgType uint32, msg []byte) bool {
+	if device.cookieChecker.CheckMAC1(msg) {
+		return true
+	}
+	checker := device.retiringCookieChecker(msgType)
+	return checker != nil && checker.CheckMAC1(msg)
+}
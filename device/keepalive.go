@@ -0,0 +1,147 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AdaptiveKeepaliveInitial  = time.Second * 25
+	AdaptiveKeepaliveMin      = time.Second * 5
+	AdaptiveKeepaliveMax      = time.Minute * 5
+	AdaptiveKeepaliveCycles   = 4         // intervals without the NAT mapping expiring before trying a longer one
+	AdaptiveKeepaliveResettle = time.Hour // how long a settled interval is kept before trying a longer one again
+)
+
+// adaptiveKeepalive is the state of adaptive persistent keepalives, which
+// keep the NAT mapping in front of us open with as few packets as possible.
+// The interval starts at AdaptiveKeepaliveInitial and doubles every
+// AdaptiveKeepaliveCycles intervals, up to AdaptiveKeepaliveMax, until the
+// mapping is seen to have expired. It then falls back to the longest
+// silence from the peer after which a packet from it still arrived, or to
+// half, and settles there for AdaptiveKeepaliveResettle.
+type adaptiveKeepalive struct {
+	sync.Mutex
+	enabled      atomic.Bool
+	interval     atomic.Int64 // nanoseconds
+	lastReceived atomic.Int64 // unix nanoseconds of the last authenticated packet received
+	lastSent     atomic.Int64 // unix nanoseconds of the last persistent keepalive sent
+
+	cycles    int           // intervals passed without the mapping expiring
+	proven    time.Duration // longest silence from the peer after which a packet from it arrived
+	settled   bool          // whether the mapping expired, so that the interval no longer grows
+	settledAt time.Time
+}
+
+// keepaliveInterval returns the persistent keepalive interval in use, or
+// zero if persistent keepalives are off.
+func (peer *Peer) keepaliveInterval() time.Duration {
+	if peer.keepalive.enabled.Load() {
+		return time.Duration(peer.keepalive.interval.Load())
+	}
+	return time.Duration(peer.persistentKeepaliveInterval.Load()) * time.Second
+}
+
+// setAdaptiveKeepalive turns adaptive mode on or off, starting over when
+// turned on. It reports whether it was off before.
+func (peer *Peer) setAdaptiveKeepalive(enabled bool) bool {
+	peer.keepalive.Lock()
+	defer peer.keepalive.Unlock()
+	if enabled {
+		peer.keepalive.interval.Store(int64(AdaptiveKeepaliveInitial))
+		peer.keepalive.cycles = 0
+		peer.keepalive.proven = 0
+		peer.keepalive.settled = false
+	}
+	return !peer.keepalive.enabled.Swap(enabled)
+}
+
+// keepaliveIntervalPassed is called when a persistent keepalive interval
+// passed without any authenticated packet sent, just before a keepalive is
+// sent.
+func (peer *Peer) keepaliveIntervalPassed() {
+	if !peer.keepalive.enabled.Load() {
+		return
+	}
+	now := peer.device.now()
+	peer.keepalive.lastSent.Store(now.UnixNano())
+	peer.keepalive.Lock()
+	defer peer.keepalive.Unlock()
+	interval := time.Duration(peer.keepalive.interval.Load())
+	if peer.keepalive.settled {
+		if now.Sub(peer.keepalive.settledAt) < AdaptiveKeepaliveResettle {
+			return
+		}
+		// NAT mappings may have changed since; see whether a longer
+		// interval works now.
+		peer.keepalive.settled = false
+		peer.keepalive.cycles = 0
+	}
+	if interval >= AdaptiveKeepaliveMax {
+		return
+	}
+	if peer.keepalive.cycles++; peer.keepalive.cycles < AdaptiveKeepaliveCycles {
+		return
+	}
+	peer.keepalive.cycles = 0
+	interval = min(interval*2, AdaptiveKeepaliveMax)
+	peer.keepalive.interval.Store(int64(interval))
+	peer.device.log.Verbosef("%v - Trying persistent keepalive interval of %v", peer, interval)
+}
+
+// keepaliveReceived records an authenticated packet received from the
+// peer. Only packets from the peer count: those we send say nothing about
+// whether the peer can reach us.
+func (peer *Peer) keepaliveReceived() {
+	now := peer.device.now().UnixNano()
+	last := peer.keepalive.lastReceived.Swap(now)
+	if last == 0 || !peer.keepalive.enabled.Load() {
+		return
+	}
+	silence := time.Duration(now - last)
+	peer.keepalive.Lock()
+	peer.keepalive.proven = max(peer.keepalive.proven, silence)
+	peer.keepalive.Unlock()
+}
+
+// keepaliveCheckInitiation is called when the peer initiates a handshake,
+// before the initiation is recorded as received, to tell whether the NAT
+// mapping expired. The peer initiates once its packets go unanswered, and
+// its first initiation to get through follows our next keepalive, which
+// opens a new mapping. So the mapping is taken to have expired if we had
+// not heard from the peer for at least half an interval, and the
+// initiation arrives within a handshake retry of our last keepalive.
+// Rekeying alone makes neither likely, whatever the age of the session.
+func (peer *Peer) keepaliveCheckInitiation() {
+	if !peer.keepalive.enabled.Load() {
+		return
+	}
+	now := peer.device.now().UnixNano()
+	failed := time.Duration(peer.keepalive.interval.Load())
+	lastReceived, lastSent := peer.keepalive.lastReceived.Load(), peer.keepalive.lastSent.Load()
+	if lastReceived == 0 || time.Duration(now-lastReceived) < failed/2 {
+		return
+	}
+	if lastSent == 0 || time.Duration(now-lastSent) > RekeyTimeout+time.Millisecond*RekeyTimeoutJitterMaxMs {
+		return
+	}
+
+	peer.keepalive.Lock()
+	defer peer.keepalive.Unlock()
+	interval := failed / 2
+	if proven := peer.keepalive.proven; proven > interval && proven < failed {
+		interval = proven
+	}
+	interval = max(interval, AdaptiveKeepaliveMin)
+	peer.keepalive.interval.Store(int64(interval))
+	peer.keepalive.cycles = 0
+	peer.keepalive.settled = true
+	peer.keepalive.settledAt = peer.device.now()
+	peer.device.log.Verbosef("%v - NAT mapping expired with persistent keepalive interval of %v, settling on %v", peer, failed, interval)
+}
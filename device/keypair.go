@@ -28,6 +28,7 @@ type Keypair struct {
 	replayFilter replay.Filter
 	isInitiator  bool
 	created      time.Time
+	txBytesBase  uint64 // peer's txBytes when the keypair was created
 	localIndex   uint32
 	remoteIndex  uint32
 }
@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A LoadMode selects how the device decides whether it is under load. Under
+// load, handshake messages must carry a valid MAC2, proving they come from
+// where they say, or be answered with a cookie reply instead; those that do
+// are then rate limited. By default the device is under load while at least
+// LoadPolicy.Threshold handshake messages are queued, and for
+// LoadPolicy.HoldTime after. An operator expecting an attack may instead
+// force load mode on, or force it off.
+type LoadMode int32
+
+const (
+	LoadModeAuto LoadMode = iota // under load by handshake queue length
+	LoadModeOn                   // always under load
+	LoadModeOff                  // never under load
+)
+
+func (mode LoadMode) String() string {
+	switch mode {
+	case LoadModeAuto:
+		return "auto"
+	case LoadModeOn:
+		return "on"
+	case LoadModeOff:
+		return "off"
+	}
+	return fmt.Sprintf("LoadMode(%d)", int32(mode))
+}
+
+func parseLoadMode(s string) (LoadMode, error) {
+	for mode := LoadModeAuto; mode <= LoadModeOff; mode++ {
+		if s == mode.String() {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid load mode %q", s)
+}
+
+// LoadPolicy configures load mode.
+type LoadPolicy struct {
+	Mode      LoadMode
+	Threshold int           // queued handshake messages that put the device under load, or zero for QueueHandshakeSize/8
+	HoldTime  time.Duration // how long the device stays under load after, or zero for UnderLoadAfterTime
+}
+
+// A LoadHandler is told when the device enters or leaves load mode. It is
+// called with load state locked, so it should return quickly and must not
+// call SetLoadPolicy or SetLoadHandler.
+type LoadHandler func(underLoad bool)
+
+type loadState struct {
+	sync.Mutex
+	mode      atomic.Int32
+	threshold atomic.Int64
+	holdTime  atomic.Int64
+	underLoad atomic.Bool // whether LoadHandler was last told the device is under load
+	handler   LoadHandler
+	timer     ClockTimer // for leaving load mode once the hold time has passed
+}
+
+func (device *Device) SetLoadPolicy(policy LoadPolicy) {
+	device.load.Lock()
+	defer device.load.Unlock()
+	device.load.mode.Store(int32(policy.Mode))
+	device.load.threshold.Store(int64(max(policy.Threshold, 0)))
+	device.load.holdTime.Store(int64(max(policy.HoldTime, 0)))
+	switch policy.Mode {
+	case LoadModeOn:
+		device.setUnderLoadLocked(true)
+	case LoadModeOff:
+		device.setUnderLoadLocked(false)
+	default:
+		device.checkLoadLocked()
+	}
+}
+
+func (device *Device) LoadPolicy() LoadPolicy {
+	return LoadPolicy{
+		Mode:      LoadMode(device.load.mode.Load()),
+		Threshold: int(device.load.threshold.Load()),
+		HoldTime:  time.Duration(device.load.holdTime.Load()),
+	}
+}
+
+// SetLoadHandler sets the handler told when the device enters or leaves
+// load mode. Passing nil removes it.
+func (device *Device) SetLoadHandler(handler LoadHandler) {
+	device.load.Lock()
+	defer device.load.Unlock()
+	device.load.handler = handler
+}
+
+func (device *Device) IsUnderLoad() bool {
+	switch LoadMode(device.load.mode.Load()) {
+	case LoadModeOn:
+		return true
+	case LoadModeOff:
+		return false
+	}
+
+	// check if currently under load
+	now := device.now()
+	threshold := int(device.load.threshold.Load())
+	if threshold == 0 {
+		threshold = QueueHandshakeSize / 8
+	}
+	underLoad := device.queue.handshake.len() >= threshold
+	if underLoad {
+		holdTime := time.Duration(device.load.holdTime.Load())
+		if holdTime == 0 {
+			holdTime = UnderLoadAfterTime
+		}
+		device.rate.underLoadUntil.Store(now.Add(holdTime).UnixNano())
+		if !device.load.underLoad.Load() {
+			device.load.Lock()
+			device.setUnderLoadLocked(true)
+			device.load.Unlock()
+		}
+		return true
+	}
+	// check if recently under load
+	return device.rate.underLoadUntil.Load() > now.UnixNano()
+}
+
+// checkLoadLocked leaves load mode if the hold time has passed in
+// LoadModeAuto, or waits until it will have.
+func (device *Device) checkLoadLocked() {
+	if !device.load.underLoad.Load() || LoadMode(device.load.mode.Load()) != LoadModeAuto {
+		return
+	}
+	remaining := time.Duration(device.rate.underLoadUntil.Load() - device.now().UnixNano())
+	if remaining <= 0 {
+		device.setUnderLoadLocked(false)
+		return
+	}
+	if device.load.timer == nil {
+		device.load.timer = device.clock.AfterFunc(remaining, func() {
+			device.load.Lock()
+			defer device.load.Unlock()
+			device.checkLoadLocked()
+		})
+	} else {
+		device.load.timer.Reset(remaining)
+	}
+}
+
+func (device *Device) setUnderLoadLocked(underLoad bool) {
+	if device.load.underLoad.Load() == underLoad {
+		return
+	}
+	device.load.underLoad.Store(underLoad)
+	if underLoad {
+		device.log.Verbosef("Device entering load mode")
+	} else {
+		device.log.Verbosef("Device leaving load mode")
+	}
+	if device.load.handler != nil {
+		device.load.handler(underLoad)
+	}
+	if underLoad {
+		device.checkLoadLocked()
+	} else if device.load.timer != nil {
+		device.load.timer.Stop()
+	}
+}
+
+// stopLoadTimer stops the timer for leaving load mode on Close.
+func (device *Device) stopLoadTimer() {
+	device.load.Lock()
+	defer device.load.Unlock()
+	if device.load.timer != nil {
+		device.load.timer.Stop()
+	}
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// MinCustomMessageType is the smallest message type passed to a
+// MessageHandler.
+const MinCustomMessageType = 0x80
+
+// A MessageHandler handles a message of a custom type received from
+// endpoint. Messages whose type is at least MinCustomMessageType are not
+// WireGuard messages, and are passed to the handler registered for their
+// type, so that applications can share the device's socket for their own
+// signaling. They are neither authenticated nor encrypted, and are sent with
+// SendRaw. It is called by the receiving goroutine, so it should return
+// quickly, and msg, including its type, is only valid until it does.
+type MessageHandler func(msg []byte, endpoint conn.Endpoint)
+
+type messageHandlers struct {
+	sync.RWMutex
+	handlers map[uint32]MessageHandler
+}
+
+// SetMessageHandler sets the handler for messages of type msgType, which
+// must be at least MinCustomMessageType. Passing nil removes it.
+func (device *Device) SetMessageHandler(msgType uint32, handler MessageHandler) error {
+	if msgType < MinCustomMessageType {
+		return fmt.Errorf("message type %d is reserved", msgType)
+	}
+	device.messageHandlers.Lock()
+	defer device.messageHandlers.Unlock()
+	if handler == nil {
+		delete(device.messageHandlers.handlers, msgType)
+		return nil
+	}
+	if device.messageHandlers.handlers == nil {
+		device.messageHandlers.handlers = make(map[uint32]MessageHandler)
+	}
+	device.messageHandlers.handlers[msgType] = handler
+	return nil
+}
+
+func (device *Device) messageHandler(msgType uint32) MessageHandler {
+	device.messageHandlers.RLock()
+	defer device.messageHandlers.RUnlock()
+	return device.messageHandlers.handlers[msgType]
+}
+
+// SendRaw sends msg, which must start with a little-endian custom message
+// type, to endpoint on the device's socket.
+func (device *Device) SendRaw(endpoint conn.Endpoint, msg []byte) error {
+	if len(msg) < 4 || len(msg) > MaxMessageSize {
+		return errors.New("invalid message size")
+	}
+	if msgType := binary.LittleEndian.Uint32(msg); msgType < MinCustomMessageType {
+		return fmt.Errorf("message type %d is reserved", msgType)
+	}
+	return device.sendTo(endpoint, msg)
+}
+
+// sendTo sends packet to endpoint, without a peer.
+func (device *Device) sendTo(endpoint conn.Endpoint, packet []byte) error {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if device.isClosed() {
+		return errors.New("device closed")
+	}
+	return device.net.bind.Send([][]byte{packet}, endpoint)
+}
@@ -16,6 +16,7 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/tai64n"
 )
 
@@ -220,9 +221,15 @@ type Handshake struct {
 	remoteStatic              NoisePublicKey           // long term key
 	remoteEphemeral           NoisePublicKey           // ephemeral public key
 	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
+	retiringStaticStatic      [NoisePublicKeySize]byte // precomputed shared secret of the retiring identity
 	lastTimestamp             tai64n.Timestamp
+	lastSentTimestamp         tai64n.Timestamp
 	lastInitiationConsumption time.Time
 	lastSentHandshake         time.Time
+	lastSentInitiation        time.Time // when the initiation of the current handshake was created
+
+	presharedKeys     [MaxPresharedKeys]NoisePresharedKey // psks taken for the current handshake
+	presharedKeyCount int
 }
 
 var (
@@ -248,6 +255,7 @@ func (h *Handshake) Clear() {
 	setZero(h.remoteEphemeral[:])
 	setZero(h.chainKey[:])
 	setZero(h.hash[:])
+	h.clearPresharedKeys()
 	h.localIndex = 0
 	h.state = handshakeZeroed
 }
@@ -268,6 +276,8 @@ func init() {
 }
 
 func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, error) {
+	device.reserveTimestamps()
+
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
@@ -320,7 +330,8 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		handshake.chainKey[:],
 		handshake.precomputedStaticStatic[:],
 	)
-	timestamp := tai64n.Now()
+	timestamp := device.nextTimestamp(handshake.lastSentTimestamp)
+	handshake.lastSentTimestamp = timestamp
 	aead, _ = chacha20poly1305.New(key[:])
 	aead.Seal(msg.Timestamp[:0], ZeroNonce[:], timestamp[:], handshake.hash[:])
 
@@ -333,47 +344,77 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	handshake.localIndex = msg.Sender
 
 	handshake.mixHash(msg.Timestamp[:])
+	peer.loadPresharedKeysLocked()
 	handshake.state = handshakeInitiationCreated
+	handshake.lastSentInitiation = device.now()
 	return &msg, nil
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	peer, failure := device.consumeMessageInitiation(msg, false, nil)
+	if failure != 0 {
+		return nil
+	}
+	return peer
+}
+
+// consumeMessageInitiation consumes msg as addressed to the retiring
+// identity of the device if retiring is set, and to the current one if not.
+// If endpoint is set, initiations from unknown peers are passed on to the
+// UnknownPeerHandler. On failure, the peer is returned along with the reason
+// if it is known.
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation, retiring bool, endpoint conn.Endpoint) (*Peer, HandshakeFailure) {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
 
 	if msg.Type != MessageInitiationType {
-		return nil
+		return nil, HandshakeFailureMalformed
 	}
 
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
+	staticKey, publicKey := device.staticIdentity.key, &device.staticIdentity.publicKey
+	if retiring {
+		identity := device.staticIdentity.retiring
+		if identity == nil {
+			return nil, HandshakeFailureWrongRecipient
+		}
+		staticKey, publicKey = identity.key, &identity.publicKey
+	}
+
+	mixHash(&hash, &InitialHash, publicKey[:])
 	mixHash(&hash, &hash, msg.Ephemeral[:])
 	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
 
 	// decrypt static key
 	var peerPK NoisePublicKey
 	var key [chacha20poly1305.KeySize]byte
-	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+	ss, err := staticSharedSecret(staticKey, msg.Ephemeral)
 	if err != nil {
-		return nil
+		return nil, HandshakeFailureInvalidKey
 	}
 	KDF2(&chainKey, &key, chainKey[:], ss[:])
 	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
 	if err != nil {
-		return nil
+		return nil, HandshakeFailureWrongRecipient
 	}
 	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
 	peer := device.LookupPeer(peerPK)
-	if peer == nil || !peer.isRunning.Load() {
-		return nil
+	if peer == nil && endpoint != nil {
+		device.handleUnknownInitiator(msg, retiring, endpoint, staticKey, peerPK, chainKey, hash)
+	}
+	if peer == nil {
+		return nil, HandshakeFailureUnknownPeer
+	}
+	if !peer.isRunning.Load() {
+		return peer, HandshakeFailurePeerStopped
 	}
 
 	handshake := &peer.handshake
@@ -384,36 +425,49 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	handshake.mutex.RLock()
 
-	if isZero(handshake.precomputedStaticStatic[:]) {
+	staticStatic := &handshake.precomputedStaticStatic
+	if retiring {
+		staticStatic = &handshake.retiringStaticStatic
+	}
+	if isZero(staticStatic[:]) {
 		handshake.mutex.RUnlock()
-		return nil
+		return peer, HandshakeFailureInvalidKey
 	}
 	KDF2(
 		&chainKey,
 		&key,
 		chainKey[:],
-		handshake.precomputedStaticStatic[:],
+		staticStatic[:],
 	)
 	aead, _ = chacha20poly1305.New(key[:])
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		return nil
+		return peer, HandshakeFailureAuthentication
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
 	// protect against replay & flood
 
 	replay := !timestamp.After(handshake.lastTimestamp)
-	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
+	var behind time.Duration
+	if replay {
+		behind = handshake.lastTimestamp.Time().Sub(timestamp.Time())
+	}
+	flood := device.since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
-		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
-		return nil
+		peer.timestampBehind.Store(int64(behind))
+		if behind > 0 {
+			device.log.Verbosef("%v - Initiation timestamp %v is %v behind the last accepted: replayed, or the peer's clock went backwards", peer, timestamp, behind)
+		}
+		return peer, HandshakeFailureReplay
 	}
 	if flood {
-		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood", peer)
-		return nil
+		return peer, HandshakeFailureFlood
+	}
+	if endpoint != nil && !peer.endpointAllowed(endpoint) {
+		return peer, HandshakeFailureEndpointNotAllowed
 	}
 
 	// update handshake state
@@ -426,11 +480,13 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	handshake.remoteEphemeral = msg.Ephemeral
 	if timestamp.After(handshake.lastTimestamp) {
 		handshake.lastTimestamp = timestamp
+		peer.timestampBehind.Store(0)
 	}
-	now := time.Now()
+	now := device.now()
 	if now.After(handshake.lastInitiationConsumption) {
 		handshake.lastInitiationConsumption = now
 	}
+	peer.loadPresharedKeysLocked()
 	handshake.state = handshakeInitiationConsumed
 
 	handshake.mutex.Unlock()
@@ -438,7 +494,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return peer
+	return peer, 0
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
@@ -495,7 +551,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 		&tau,
 		&key,
 		handshake.chainKey[:],
-		handshake.presharedKey[:],
+		handshake.presharedKeys[0][:],
 	)
 
 	handshake.mixHash(tau[:])
@@ -510,16 +566,26 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
-	if msg.Type != MessageResponseType {
+	peer, failure := device.consumeMessageResponse(msg)
+	if failure != 0 {
 		return nil
 	}
+	return peer
+}
+
+// consumeMessageResponse is ConsumeMessageResponse, returning the reason for
+// failure, and the peer if it is known.
+func (device *Device) consumeMessageResponse(msg *MessageResponse) (*Peer, HandshakeFailure) {
+	if msg.Type != MessageResponseType {
+		return nil, HandshakeFailureMalformed
+	}
 
 	// lookup handshake by receiver
 
 	lookup := device.indexTable.Lookup(msg.Receiver)
 	handshake := lookup.handshake
 	if handshake == nil {
-		return nil
+		return nil, HandshakeFailureUnknownIndex
 	}
 
 	var (
@@ -527,14 +593,14 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		chainKey [blake2s.Size]byte
 	)
 
-	ok := func() bool {
+	failure := func() HandshakeFailure {
 		// lock handshake state
 
 		handshake.mutex.RLock()
 		defer handshake.mutex.RUnlock()
 
 		if handshake.state != handshakeInitiationCreated {
-			return false
+			return HandshakeFailureWrongState
 		}
 
 		// lock private key for reading
@@ -549,44 +615,49 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 
 		ss, err := handshake.localEphemeral.sharedSecret(msg.Ephemeral)
 		if err != nil {
-			return false
+			return HandshakeFailureInvalidKey
 		}
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
-		ss, err = device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
+		ss, err = staticSharedSecret(device.staticIdentity.key, msg.Ephemeral)
 		if err != nil {
-			return false
+			return HandshakeFailureInvalidKey
 		}
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
-		// add preshared key (psk)
-
-		var tau [blake2s.Size]byte
-		var key [chacha20poly1305.KeySize]byte
-		KDF3(
-			&chainKey,
-			&tau,
-			&key,
-			chainKey[:],
-			handshake.presharedKey[:],
-		)
-		mixHash(&hash, &hash, tau[:])
-
-		// authenticate transcript
-
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err = aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
-		if err != nil {
-			return false
+		// add preshared key (psk), trying each one the responder may have used
+
+		preKeyHash, preKeyChainKey := hash, chainKey
+		defer setZero(preKeyChainKey[:])
+		for i := range handshake.presharedKeys[:handshake.presharedKeyCount] {
+			var tau [blake2s.Size]byte
+			var key [chacha20poly1305.KeySize]byte
+			KDF3(
+				&chainKey,
+				&tau,
+				&key,
+				preKeyChainKey[:],
+				handshake.presharedKeys[i][:],
+			)
+			mixHash(&hash, &preKeyHash, tau[:])
+
+			// authenticate transcript
+
+			aead, _ := chacha20poly1305.New(key[:])
+			_, err = aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
+			setZero(key[:])
+			if err == nil {
+				mixHash(&hash, &hash, msg.Empty[:])
+				return 0
+			}
 		}
-		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+		return HandshakeFailureAuthentication
 	}()
 
-	if !ok {
-		return nil
+	if failure != 0 {
+		return lookup.peer, failure
 	}
 
 	// update handshake state
@@ -603,7 +674,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return lookup.peer
+	return lookup.peer, 0
 }
 
 /* Derives a new keypair from the current handshake state
@@ -657,7 +728,8 @@ func (peer *Peer) BeginSymmetricSession() error {
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
+	keypair.created = device.now()
+	keypair.txBytesBase = peer.txBytes.Load()
 	keypair.replayFilter.Reset()
 	keypair.isInitiator = isInitiator
 	keypair.localIndex = peer.handshake.localIndex
@@ -8,9 +8,14 @@ package device
 import (
 	"bytes"
 	"encoding/binary"
+	"net/netip"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tai64n"
 	"golang.zx2c4.com/wireguard/tun/tuntest"
 )
 
@@ -32,14 +37,14 @@ func TestCurveWrappers(t *testing.T) {
 	}
 }
 
-func randDevice(t *testing.T) *Device {
+func randDevice(t *testing.T, opts ...DeviceOption) *Device {
 	sk, err := newPrivateKey()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tun := tuntest.NewChannelTUN()
 	logger := NewLogger(LogLevelError, "")
-	device := NewDevice(tun.TUN(), conn.NewDefaultBind(), logger)
+	device := NewDevice(tun.TUN(), conn.NewDefaultBind(), logger, opts...)
 	device.SetPrivateKey(sk)
 	return device
 }
@@ -177,3 +182,435 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+func TestPresharedKeyRotation(t *testing.T) {
+	var oldKey, newKey NoisePresharedKey
+	oldKey[0], newKey[0] = 1, 2
+
+	handshake := func(initiatorKeys, responderKeys []NoisePresharedKey) bool {
+		dev1 := randDevice(t)
+		dev2 := randDevice(t)
+		defer dev1.Close()
+		defer dev2.Close()
+
+		pk1 := dev1.staticIdentity.privateKey.publicKey()
+		pk2 := dev2.staticIdentity.privateKey.publicKey()
+		peer1, err := dev2.NewPeer(pk1)
+		assertNil(t, err)
+		peer2, err := dev1.NewPeer(pk2)
+		assertNil(t, err)
+		peer1.Start()
+		peer2.Start()
+
+		rotator1, rotator2 := NewPresharedKeyRotator(), NewPresharedKeyRotator()
+		for _, key := range initiatorKeys {
+			rotator1.Rotate(pk2, key, time.Minute)
+		}
+		for _, key := range responderKeys {
+			rotator2.Rotate(pk1, key, time.Minute)
+		}
+		dev1.SetPresharedKeyProvider(rotator1)
+		dev2.SetPresharedKeyProvider(rotator2)
+
+		msg1, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		if dev2.ConsumeMessageInitiation(msg1) == nil {
+			t.Fatal("handshake failed at initiation message")
+		}
+		msg2, err := dev2.CreateMessageResponse(peer1)
+		assertNil(t, err)
+		if dev1.ConsumeMessageResponse(msg2) == nil {
+			return false
+		}
+		assertEqual(t, peer1.handshake.chainKey[:], peer2.handshake.chainKey[:])
+		return true
+	}
+
+	if !handshake([]NoisePresharedKey{oldKey}, []NoisePresharedKey{oldKey, newKey}) {
+		t.Error("handshake failed with only the responder rotated")
+	}
+	if !handshake([]NoisePresharedKey{oldKey, newKey}, []NoisePresharedKey{oldKey}) {
+		t.Error("handshake failed with only the initiator rotated")
+	}
+	if !handshake([]NoisePresharedKey{oldKey, newKey}, []NoisePresharedKey{newKey}) {
+		t.Error("handshake failed with the responder past the overlap")
+	}
+	if handshake([]NoisePresharedKey{oldKey}, []NoisePresharedKey{newKey}) {
+		t.Error("handshake succeeded with mismatched keys")
+	}
+}
+
+func TestPresharedKeyRotatorOverlap(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	rotator := NewPresharedKeyRotator()
+	rotator.SetClock(clock)
+
+	var pk NoisePublicKey
+	oldKey, newKey := NoisePresharedKey{1}, NoisePresharedKey{2}
+	rotator.Rotate(pk, oldKey, time.Minute)
+	rotator.Rotate(pk, newKey, time.Minute)
+
+	keys := rotator.PresharedKeys(pk)
+	if len(keys) != 2 || keys[0] != oldKey || keys[1] != newKey {
+		t.Fatalf("keys during overlap are %v, want old then new", keys)
+	}
+	clock.Advance(time.Minute - time.Second)
+	if n := len(rotator.PresharedKeys(pk)); n != 2 {
+		t.Fatalf("%d keys just before the end of the overlap, want 2", n)
+	}
+	clock.Advance(time.Second)
+	keys = rotator.PresharedKeys(pk)
+	if len(keys) != 1 || keys[0] != newKey {
+		t.Fatalf("keys after overlap are %v, want only new", keys)
+	}
+	if !isZero(rotator.keys[pk].previous[:]) {
+		t.Error("old key not zeroed after overlap")
+	}
+}
+
+func TestPrivateKeyRotation(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	oldPK := dev2.staticIdentity.privateKey.publicKey()
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	assertNil(t, err)
+	peer2, err := dev1.NewPeer(oldPK)
+	assertNil(t, err)
+	peer1.Start()
+	peer2.Start()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev2.RotatePrivateKey(sk, time.Minute))
+
+	// dev1 still knows dev2 by its old public key
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	packet := make([]byte, MessageInitiationSize)
+	assertNil(t, msg1.marshal(packet))
+	peer2.cookieGenerator.AddMacs(packet)
+	if dev2.cookieChecker.CheckMAC1(packet) {
+		t.Fatal("mac1 for old key accepted by new identity")
+	}
+	checker := dev2.retiringCookieChecker(MessageInitiationType)
+	if checker == nil || !checker.CheckMAC1(packet) {
+		t.Fatal("mac1 for old key not accepted during transition")
+	}
+	if dev2.ConsumeMessageInitiation(msg1) != nil {
+		t.Fatal("initiation to old key consumed by new identity")
+	}
+	if _, failure := dev2.consumeMessageInitiation(msg1, true, nil); failure != 0 {
+		t.Fatal("initiation to old key not consumed during transition")
+	}
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageResponse(msg2) == nil {
+		t.Fatal("handshake failed at response message")
+	}
+	assertEqual(t, peer1.handshake.chainKey[:], peer2.handshake.chainKey[:])
+
+	// once retired, the old key is no longer accepted
+
+	retiredKey := dev2.staticIdentity.retiring.key.(*SoftwareStaticKey)
+	dev2.retirePrivateKey(dev2.staticIdentity.retiring)
+	if dev2.retiringCookieChecker(MessageInitiationType) != nil {
+		t.Fatal("retiring identity still present after retirement")
+	}
+	if !retiredKey.privateKey.IsZero() {
+		t.Fatal("retired private key not zeroed")
+	}
+	msg1, err = dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if _, failure := dev2.consumeMessageInitiation(msg1, true, nil); failure == 0 {
+		t.Fatal("initiation to old key consumed after retirement")
+	}
+}
+
+// opaqueStaticKey hides that a key is a SoftwareStaticKey, like one held
+// by an agent.
+type opaqueStaticKey struct {
+	StaticKey
+}
+
+func TestExternalStaticKey(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev2.SetStaticKey(opaqueStaticKey{NewSoftwareStaticKey(sk)}))
+	if !dev2.staticIdentity.privateKey.IsZero() {
+		t.Fatal("private key of external key kept")
+	}
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	assertNil(t, err)
+	peer2, err := dev1.NewPeer(sk.publicKey())
+	assertNil(t, err)
+	peer1.Start()
+	peer2.Start()
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg1) == nil {
+		t.Fatal("handshake failed at initiation message")
+	}
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageResponse(msg2) == nil {
+		t.Fatal("handshake failed at response message")
+	}
+	assertEqual(t, peer1.handshake.chainKey[:], peer2.handshake.chainKey[:])
+
+	config, err := dev2.IpcGet()
+	assertNil(t, err)
+	if strings.Contains(config, "private_key=") {
+		t.Error("private key of external key reported by UAPI")
+	}
+}
+
+// lockCheckingKey records whether SharedSecret was called with the device
+// locked.
+type lockCheckingKey struct {
+	StaticKey
+	device *Device
+	calls  int
+	locked int
+}
+
+func (key *lockCheckingKey) SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	key.calls++
+	if !key.device.peers.TryRLock() {
+		key.locked++
+	} else {
+		key.device.peers.RUnlock()
+	}
+	return key.StaticKey.SharedSecret(pk)
+}
+
+func TestStaticKeyPrecomputedUnlocked(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	_, err := dev2.NewPeer(dev1.staticIdentity.publicKey)
+	assertNil(t, err)
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	key := &lockCheckingKey{StaticKey: NewSoftwareStaticKey(sk), device: dev2}
+	assertNil(t, dev2.SetStaticKey(key))
+	if key.calls != 1 || key.locked != 0 {
+		t.Fatalf("%d of %d shared secrets computed with the device locked", key.locked, key.calls)
+	}
+	peer := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+	want, err := sk.sharedSecret(dev1.staticIdentity.publicKey)
+	assertNil(t, err)
+	assertEqual(t, peer.handshake.precomputedStaticStatic[:], want[:])
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	dev3 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+	defer dev3.Close()
+
+	expect := func(failure, want HandshakeFailure, what string) {
+		t.Helper()
+		if failure != want {
+			t.Fatalf("%s: got failure %v, want %v", what, failure, want)
+		}
+	}
+
+	pk1 := dev1.staticIdentity.privateKey.publicKey()
+	pk2 := dev2.staticIdentity.privateKey.publicKey()
+	peer2, err := dev1.NewPeer(pk2)
+	assertNil(t, err)
+	peer2.Start()
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	_, failure := dev3.consumeMessageInitiation(msg1, false, nil)
+	expect(failure, HandshakeFailureWrongRecipient, "initiation to another key")
+	_, failure = dev2.consumeMessageInitiation(msg1, false, nil)
+	expect(failure, HandshakeFailureUnknownPeer, "initiation from unknown peer")
+
+	assertNil(t, dev2.Up()) // so that the TUN coming up does not start the peer
+	peer1, err := dev2.NewPeer(pk1)
+	assertNil(t, err)
+	peer, failure := dev2.consumeMessageInitiation(msg1, false, nil)
+	expect(failure, HandshakeFailurePeerStopped, "initiation to stopped peer")
+	if peer != peer1 {
+		t.Fatal("peer of failure not returned")
+	}
+
+	peer1.Start()
+	_, failure = dev2.consumeMessageInitiation(msg1, false, nil)
+	expect(failure, 0, "initiation")
+	_, failure = dev2.consumeMessageInitiation(msg1, false, nil)
+	expect(failure, HandshakeFailureReplay, "replayed initiation")
+
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	unknown := *msg2
+	unknown.Receiver++
+	_, failure = dev1.consumeMessageResponse(&unknown)
+	expect(failure, HandshakeFailureUnknownIndex, "response to unknown index")
+	_, failure = dev1.consumeMessageResponse(msg2)
+	expect(failure, 0, "response")
+	_, failure = dev1.consumeMessageResponse(msg2)
+	expect(failure, HandshakeFailureWrongState, "replayed response")
+
+	endpoint := &conn.StdNetEndpoint{AddrPort: netip.MustParseAddrPort("192.0.2.1:51820")}
+	dev2.handshakeFailed(peer1, HandshakeFailureReplay, "initiation", endpoint)
+	dev2.handshakeFailed(nil, HandshakeFailureWrongRecipient, "initiation", endpoint)
+	config, err := dev2.IpcGet()
+	assertNil(t, err)
+	for _, line := range []string{"handshake_failure_replay_count=1", "handshake_failure_wrong_recipient_count=1"} {
+		if !strings.Contains(config, line+"\n") {
+			t.Errorf("UAPI get is missing %q", line)
+		}
+	}
+
+	// an initiation whose mac1 is keyed to someone else is counted too
+	msg1, err = dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	buffer := dev3.GetMessageBuffer()
+	packet := buffer[:MessageInitiationSize]
+	assertNil(t, msg1.marshal(packet))
+	peer2.cookieGenerator.AddMacs(packet)
+	dev3.queue.handshake.send(handshakeClassUnknown, QueueHandshakeElement{
+		msgType:  MessageInitiationType,
+		packet:   packet,
+		endpoint: endpoint,
+		buffer:   buffer,
+	})
+	for deadline := time.Now().Add(5 * time.Second); dev3.handshakeFailures[HandshakeFailureInvalidMAC1].Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("initiation with invalid mac1 not counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// and a response with a bad mac1 is counted against the peer
+	msg1, err = dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	response := MessageResponse{Type: MessageResponseType, Receiver: msg1.Sender}
+	packet = make([]byte, MessageResponseSize)
+	assertNil(t, response.marshal(packet))
+	dev1.handshakeInvalidMAC1(&QueueHandshakeElement{msgType: MessageResponseType, packet: packet, endpoint: endpoint})
+	if n := peer2.handshakeFailures[HandshakeFailureInvalidMAC1].Load(); n != 1 {
+		t.Errorf("peer counted %d responses with invalid mac1, want 1", n)
+	}
+}
+
+func TestMonotonicTimestamps(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	newDevice := func(now time.Time) (*Device, *FakeClock) {
+		clock := NewFakeClock(now)
+		dev := randDevice(t, WithClock(clock))
+		t.Cleanup(dev.Close)
+		return dev, clock
+	}
+	responder, responderClock := newDevice(start)
+	responderPeers := make(map[NoisePublicKey]*Peer)
+
+	// initiate has dev, which may share its key with an earlier device, as
+	// if restarted, initiate a handshake with the responder.
+	initiate := func(dev *Device) HandshakeFailure {
+		t.Helper()
+		pk := dev.staticIdentity.privateKey.publicKey()
+		peer, ok := responderPeers[pk]
+		if !ok {
+			var err error
+			peer, err = responder.NewPeer(pk)
+			assertNil(t, err)
+			peer.Start()
+			responderPeers[pk] = peer
+		}
+		peer2, err := dev.NewPeer(responder.staticIdentity.privateKey.publicKey())
+		assertNil(t, err)
+		peer2.Start()
+		msg, err := dev.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		responderClock.Advance(time.Second)
+		_, failure := responder.consumeMessageInitiation(msg, false, nil)
+		return failure
+	}
+
+	path := filepath.Join(t.TempDir(), "timestamp")
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	restart := func(now time.Time, store TimestampStore) *Device {
+		dev, _ := newDevice(now)
+		dev.SetPrivateKey(sk)
+		if store != nil {
+			assertNil(t, dev.SetTimestampStore(store))
+		}
+		return dev
+	}
+
+	dev := restart(start, NewFileTimestampStore(path))
+	if failure := initiate(dev); failure != 0 {
+		t.Fatalf("initiation failed: %v", failure)
+	}
+	stored, err := NewFileTimestampStore(path).LoadTimestamp()
+	assertNil(t, err)
+	if !stored.After(tai64n.FromTime(start)) {
+		t.Fatal("bound stored is not after the timestamp sent")
+	}
+
+	// within the same run, timestamps hold while the clock goes back
+	peer := dev.LookupPeer(responder.staticIdentity.privateKey.publicKey())
+	dev.clock.(*FakeClock).Advance(-time.Hour)
+	msg, err := dev.CreateMessageInitiation(peer)
+	assertNil(t, err)
+	responderClock.Advance(time.Second)
+	if _, failure := responder.consumeMessageInitiation(msg, false, nil); failure != 0 {
+		t.Fatalf("initiation after the clock went back failed: %v", failure)
+	}
+
+	// after a restart, the stored bound keeps them from going back
+	if failure := initiate(restart(start.Add(-time.Hour), NewFileTimestampStore(path))); failure != 0 {
+		t.Fatalf("initiation after restart with clock behind failed: %v", failure)
+	}
+
+	// without it, the responder rejects them and reports by how much
+	if failure := initiate(restart(start.Add(-time.Hour), nil)); failure != HandshakeFailureReplay {
+		t.Fatalf("initiation after restart without store: got failure %v, want %v", failure, HandshakeFailureReplay)
+	}
+	behind := time.Duration(responderPeers[sk.publicKey()].timestampBehind.Load())
+	if behind < time.Hour || behind > time.Hour+TimestampReservation+time.Second {
+		t.Errorf("rejected timestamp reported %v behind, want about an hour", behind)
+	}
+
+	// restarts in quick succession do not push the bound ever further ahead
+	later := start.Add(2 * time.Hour)
+	for i := 0; i < 3; i++ {
+		now := later.Add(time.Duration(i) * time.Second)
+		if failure := initiate(restart(now, NewFileTimestampStore(path))); failure != 0 {
+			t.Fatalf("initiation after restart %d failed: %v", i, failure)
+		}
+		stored, err := NewFileTimestampStore(path).LoadTimestamp()
+		assertNil(t, err)
+		if stored.After(tai64n.FromTime(now.Add(TimestampReservation))) {
+			t.Fatalf("bound stored after restart %d is %v ahead of the clock", i, stored.Time().Sub(now))
+		}
+	}
+
+	// timestamps sent to one peer hold for the next, even without a store
+	dev = restart(later, nil)
+	first := dev.nextTimestamp(tai64n.Timestamp{})
+	dev.clock.(*FakeClock).Advance(-time.Hour)
+	if next := dev.nextTimestamp(tai64n.Timestamp{}); !next.After(first) {
+		t.Error("timestamp for a new peer went back with the clock")
+	}
+}
@@ -8,6 +8,7 @@ package device
 import (
 	"container/list"
 	"errors"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,14 +24,42 @@ type Peer struct {
 	stopping          sync.WaitGroup // routines pending stop
 	txBytes           atomic.Uint64  // bytes send to peer (endpoint)
 	rxBytes           atomic.Uint64  // bytes received from peer
+	rejectedEndpoints atomic.Uint64  // packets from outside the endpoint allowed IPs
+	roamsAccepted     atomic.Uint64  // endpoint changes made by roaming
+	roamsSuppressed   atomic.Uint64  // endpoint changes prevented by the roaming policy
 	lastHandshakeNano atomic.Int64   // nano seconds since epoch
 
+	handshakeFailures [numHandshakeFailures]atomic.Uint64 // messages rejected, by reason
+	timestampBehind   atomic.Int64                        // how far behind a rejected initiation timestamp was, until one is accepted
+	probe             chan probeResult                    // results, if the peer is a temporary one made by Device.Probe
+	path              pathQuality                         // round trip times and loss, overall and by endpoint
+
+	rekey struct {
+		afterTime       atomic.Int64 // per-peer limits, or zero for the defaults
+		rejectAfterTime atomic.Int64 // nanoseconds, as are afterTime
+		afterMessages   atomic.Uint64
+		afterBytes      atomic.Uint64
+	}
+
 	endpoint struct {
 		sync.Mutex
 		val            conn.Endpoint
+		learned        bool // val was learned from an authenticated packet, not configured
 		clearSrcOnTx   bool // signal to val.ClearSrc() prior to next packet transmission
 		disableRoaming bool
+		relay          conn.Endpoint   // path through the relay server, if the bind supports it
+		viaRelay       bool            // send through relay rather than val
+		candidates     []conn.Endpoint // configured endpoints, in order of preference
+		names          []string        // configured endpoints, if any of them need resolving
+		resolveTTL     time.Duration   // how long until names should be resolved again
+		allowedIPs     []netip.Prefix  // networks the peer may send from, or nil for any
+		roaming        roamingMode     // whether the peer may move to where packets come from
+		roamThreshold  uint32          // consecutive packets from a new address needed to roam
+		roamPending    conn.Endpoint   // new address packets are coming from, if below threshold
+		roamCount      uint32          // packets so far from roamPending
 	}
+	resolving    atomic.Bool // whether names are being resolved in the background
+	resolveAgain atomic.Bool // whether names are to be resolved once that is done
 
 	timers struct {
 		retransmitHandshake     *Timer
@@ -38,6 +67,7 @@ type Peer struct {
 		newHandshake            *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		resolveEndpoint         *Timer
 		handshakeAttempts       atomic.Uint32
 		needAnotherKeepalive    atomic.Bool
 		sentLastMinuteHandshake atomic.Bool
@@ -56,6 +86,9 @@ type Peer struct {
 	cookieGenerator             CookieGenerator
 	trieEntries                 list.List
 	persistentKeepaliveInterval atomic.Uint32
+
+	keepalive adaptiveKeepalive
+	backoff   handshakeBackoff
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
@@ -75,25 +108,39 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 		return nil, errors.New("too many peers")
 	}
 
-	// create peer
+	// map public key
+	_, ok := device.peers.keyMap[pk]
+	if ok {
+		return nil, errors.New("adding existing peer")
+	}
+
+	peer := device.newPeer(pk)
+
+	// add
+	device.peers.keyMap[pk] = peer
+
+	return peer, nil
+}
+
+// newPeer creates a peer with public key pk without adding it to the
+// device. The caller must hold device.staticIdentity.
+func (device *Device) newPeer(pk NoisePublicKey) *Peer {
 	peer := new(Peer)
 
 	peer.cookieGenerator.Init(pk)
+	peer.cookieGenerator.clock = device.clock
 	peer.device = device
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
 	peer.queue.staged = make(chan *QueueOutboundElementsContainer, QueueStagedSize)
 
-	// map public key
-	_, ok := device.peers.keyMap[pk]
-	if ok {
-		return nil, errors.New("adding existing peer")
-	}
-
 	// pre-compute DH
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
-	handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(pk)
+	handshake.precomputedStaticStatic, _ = staticSharedSecret(device.staticIdentity.key, pk)
+	if retiring := device.staticIdentity.retiring; retiring != nil {
+		handshake.retiringStaticStatic, _ = staticSharedSecret(retiring.key, pk)
+	}
 	handshake.remoteStatic = pk
 	handshake.mutex.Unlock()
 
@@ -102,30 +149,48 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	peer.endpoint.val = nil
 	peer.endpoint.disableRoaming = false
 	peer.endpoint.clearSrcOnTx = false
+	peer.endpoint.relay = nil
+	peer.endpoint.viaRelay = false
+	peer.endpoint.candidates = nil
+	peer.endpoint.names = nil
+	if device.net.relay != nil {
+		relay, err := device.net.relay.RelayEndpoint(pk)
+		if err != nil {
+			device.log.Errorf("%v - Unable to create relay endpoint: %v", peer, err)
+		}
+		peer.endpoint.relay = relay
+	}
 	peer.endpoint.Unlock()
 
 	// init timers
 	peer.timersInit()
 
-	// add
-	device.peers.keyMap[pk] = peer
-
-	return peer, nil
+	return peer
 }
 
 func (peer *Peer) SendBuffers(buffers [][]byte) error {
+	_, err := peer.sendBuffers(buffers)
+	return err
+}
+
+// sendBuffers is like SendBuffers, and also returns the endpoint the
+// buffers were sent to, if any.
+func (peer *Peer) sendBuffers(buffers [][]byte) (conn.Endpoint, error) {
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
 
 	if peer.device.isClosed() {
-		return nil
+		return nil, nil
 	}
 
 	peer.endpoint.Lock()
 	endpoint := peer.endpoint.val
+	if peer.endpoint.relay != nil && (peer.endpoint.viaRelay || endpoint == nil) {
+		endpoint = peer.endpoint.relay
+	}
 	if endpoint == nil {
 		peer.endpoint.Unlock()
-		return errors.New("no known endpoint for peer")
+		return nil, errors.New("no known endpoint for peer")
 	}
 	if peer.endpoint.clearSrcOnTx {
 		endpoint.ClearSrc()
@@ -141,7 +206,7 @@ func (peer *Peer) SendBuffers(buffers [][]byte) error {
 		}
 		peer.txBytes.Add(totalLen)
 	}
-	return err
+	return endpoint, err
 }
 
 func (peer *Peer) String() string {
@@ -192,13 +257,20 @@ func (peer *Peer) Start() {
 	peer.stopping.Add(2)
 
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(RekeyTimeout + time.Second))
 	peer.handshake.mutex.Unlock()
+	peer.resetHandshakeBackoff()
 
 	peer.device.queue.encryption.wg.Add(1) // keep encryption queue open for our writes
 
 	peer.timersStart()
 
+	peer.endpoint.Lock()
+	if len(peer.endpoint.names) > 0 {
+		peer.timers.resolveEndpoint.Mod(peer.endpoint.resolveTTL)
+	}
+	peer.endpoint.Unlock()
+
 	device.flushInboundQueue(peer.queue.inbound)
 	device.flushOutboundQueue(peer.queue.outbound)
 
@@ -242,8 +314,9 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	handshake.mutex.Lock()
 	peer.device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.device.now().Add(-(RekeyTimeout + time.Second))
 	handshake.mutex.Unlock()
+	peer.resetHandshakeBackoff()
 
 	keypairs := &peer.keypairs
 	keypairs.Lock()
@@ -279,11 +352,27 @@ func (peer *Peer) Stop() {
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	peer.endpoint.Lock()
 	defer peer.endpoint.Unlock()
-	if peer.endpoint.disableRoaming {
+	if peer.endpoint.disableRoaming || !peer.endpointAllowedLocked(endpoint) {
 		return
 	}
+	if relay := peer.device.net.relay; relay != nil && relay.IsRelayed(endpoint) {
+		// Keep the direct endpoint around so that we can probe it.
+		if !peer.endpoint.viaRelay && peer.mayUseRelayLocked() {
+			peer.device.log.Verbosef("%v - Peer is now reachable only through relay", peer)
+			peer.endpoint.viaRelay = true
+		}
+		return
+	}
+	if !peer.roamLocked(endpoint) {
+		return
+	}
+	if peer.endpoint.viaRelay {
+		peer.device.log.Verbosef("%v - Direct path restored, leaving relay", peer)
+		peer.endpoint.viaRelay = false
+	}
 	peer.endpoint.clearSrcOnTx = false
 	peer.endpoint.val = endpoint
+	peer.endpoint.learned = true
 }
 
 func (peer *Peer) markEndpointSrcForClearing() {
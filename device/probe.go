@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A ProbeFailure is why a probe failed.
+type ProbeFailure int
+
+const (
+	ProbeTimeout         ProbeFailure = iota + 1 // no response in time
+	ProbeCookieDemanded                          // the responder is under load and answered with a cookie reply
+	ProbeInvalidResponse                         // the response did not authenticate
+)
+
+func (failure ProbeFailure) String() string {
+	switch failure {
+	case ProbeTimeout:
+		return "timeout"
+	case ProbeCookieDemanded:
+		return "cookie_demanded"
+	case ProbeInvalidResponse:
+		return "invalid_response"
+	}
+	return fmt.Sprintf("ProbeFailure(%d)", int(failure))
+}
+
+func (failure ProbeFailure) Error() string {
+	switch failure {
+	case ProbeTimeout:
+		return "probe timed out"
+	case ProbeCookieDemanded:
+		return "probe answered with cookie reply"
+	case ProbeInvalidResponse:
+		return "probe answered with invalid response"
+	}
+	return failure.String()
+}
+
+type probeResult struct {
+	failure  ProbeFailure
+	received time.Time
+}
+
+// Probe sends a handshake initiation to the peer with public key pk at
+// endpoint, using preshared key psk, and returns the round trip time once
+// it responds, checking that the endpoint is alive and accepts our
+// identity. The initiation comes from a temporary peer that is never added
+// to the device, so no session is established and routing is unaffected;
+// only its receiver index is in the index table, for as long as the probe
+// lasts. The device must be up. If ctx has no deadline, Probe waits
+// for RekeyTimeout. The error is a ProbeFailure if the probe failed, or
+// ctx.Err() if ctx was canceled.
+func (device *Device) Probe(ctx context.Context, pk NoisePublicKey, psk NoisePresharedKey, endpoint conn.Endpoint) (time.Duration, error) {
+	if !device.isUp() {
+		return 0, errors.New("device not up")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, RekeyTimeout)
+		defer cancel()
+	}
+
+	device.staticIdentity.RLock()
+	peer := device.newPeer(pk)
+	device.staticIdentity.RUnlock()
+	peer.probe = make(chan probeResult, 1)
+	handshake := &peer.handshake
+	handshake.presharedKey = psk
+	defer func() {
+		handshake.mutex.Lock()
+		device.indexTable.Delete(handshake.localIndex)
+		handshake.Clear()
+		setZero(handshake.presharedKey[:])
+		handshake.mutex.Unlock()
+	}()
+
+	msg, err := device.CreateMessageInitiation(peer)
+	if err != nil {
+		return 0, err
+	}
+
+	// use psk alone, rather than what the PresharedKeyProvider has for pk
+	handshake.mutex.Lock()
+	handshake.clearPresharedKeys()
+	handshake.presharedKeys[0] = psk
+	handshake.presharedKeyCount = 1
+	handshake.mutex.Unlock()
+
+	packet := make([]byte, MessageInitiationSize)
+	_ = msg.marshal(packet)
+	peer.cookieGenerator.AddMacs(packet)
+	device.log.Verbosef("%v - Sending probe to %s", peer, endpoint.DstToString())
+	sent := device.now()
+	if err := device.sendTo(endpoint, packet); err != nil {
+		return 0, err
+	}
+
+	select {
+	case result := <-peer.probe:
+		if result.failure != 0 {
+			return 0, result.failure
+		}
+		return result.received.Sub(sent), nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return 0, ProbeTimeout
+		}
+		return 0, ctx.Err()
+	case <-device.closed:
+		return 0, errors.New("device closed")
+	}
+}
+
+// probeDone reports the result of the probe peer was made for.
+func (peer *Peer) probeDone(failure ProbeFailure) {
+	select {
+	case peer.probe <- probeResult{failure: failure, received: peer.device.now()}:
+	default:
+	}
+}
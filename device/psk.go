@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxPresharedKeys is the maximum number of preshared keys tried per
+// handshake.
+const MaxPresharedKeys = 4
+
+// A PresharedKeyProvider supplies the preshared keys used in handshakes,
+// overriding those set by the preshared_key UAPI key. It may, for instance,
+// derive them from epochs or feed in keys from a post-quantum key exchange
+// running alongside the device.
+type PresharedKeyProvider interface {
+	// PresharedKeys returns the keys currently valid for the peer with the
+	// given public key. A responder uses the first; an initiator accepts a
+	// response made with any of them. At most MaxPresharedKeys are used.
+	// Returning none falls back to the peer's configured preshared key.
+	// PresharedKeys is called with handshake state locked, so it must not
+	// block or call back into the Device.
+	PresharedKeys(publicKey NoisePublicKey) []NoisePresharedKey
+}
+
+// SetPresharedKeyProvider sets the provider of preshared keys for all peers.
+// Passing nil reverts to the keys set by UAPI.
+func (device *Device) SetPresharedKeyProvider(provider PresharedKeyProvider) {
+	device.psk.Lock()
+	defer device.psk.Unlock()
+	device.psk.provider = provider
+}
+
+func (device *Device) presharedKeyProvider() PresharedKeyProvider {
+	device.psk.RLock()
+	defer device.psk.RUnlock()
+	return device.psk.provider
+}
+
+// loadPresharedKeysLocked takes the set of preshared keys for a new handshake,
+// in CreateMessageInitiation and ConsumeMessageInitiation. The set is kept
+// with the handshake until it completes, so keys changing halfway through
+// cannot mix. The caller must hold peer.handshake.mutex for writing.
+func (peer *Peer) loadPresharedKeysLocked() {
+	handshake := &peer.handshake
+	handshake.clearPresharedKeys()
+	if provider := peer.device.presharedKeyProvider(); provider != nil {
+		keys := provider.PresharedKeys(handshake.remoteStatic)
+		handshake.presharedKeyCount = copy(handshake.presharedKeys[:], keys)
+	}
+	if handshake.presharedKeyCount == 0 {
+		handshake.presharedKeys[0] = handshake.presharedKey
+		handshake.presharedKeyCount = 1
+	}
+}
+
+func (h *Handshake) clearPresharedKeys() {
+	for i := range h.presharedKeys[:h.presharedKeyCount] {
+		setZero(h.presharedKeys[i][:])
+	}
+	h.presharedKeyCount = 0
+}
+
+// PresharedKeyRotator is a PresharedKeyProvider that keeps the previous key
+// of each peer around for an overlap window after it is rotated.
+//
+// The preshared key is only mixed in by the response, which the responder
+// creates using one key and the initiator must consume using the same. As
+// the responder has no way of knowing which keys the initiator holds, during
+// a rotation it keeps responding with the old key, which both sides still
+// have, while initiators accept a response made with either key. Once the
+// overlap window has passed, the old key is dropped everywhere.
+type PresharedKeyRotator struct {
+	mu    sync.Mutex
+	keys  map[NoisePublicKey]*rotatingPresharedKey
+	clock Clock
+}
+
+type rotatingPresharedKey struct {
+	current       NoisePresharedKey
+	previous      NoisePresharedKey
+	previousUntil time.Time
+}
+
+func NewPresharedKeyRotator() *PresharedKeyRotator {
+	return &PresharedKeyRotator{
+		keys:  make(map[NoisePublicKey]*rotatingPresharedKey),
+		clock: SystemClock,
+	}
+}
+
+// SetClock sets the clock that overlap windows are measured by, which is
+// SystemClock by default. It is usually the Clock given to the device with
+// WithClock, and is to be set before the first call to Rotate.
+func (r *PresharedKeyRotator) SetClock(clock Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = clock
+}
+
+// Rotate makes key the preshared key for the peer with the given public key,
+// continuing to accept the previous one, if any, for the overlap duration.
+func (r *PresharedKeyRotator) Rotate(publicKey NoisePublicKey, key NoisePresharedKey, overlap time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.keys[publicKey]
+	if !ok {
+		r.keys[publicKey] = &rotatingPresharedKey{current: key}
+		return
+	}
+	entry.previous = entry.current
+	entry.previousUntil = r.clock.Now().Add(overlap)
+	entry.current = key
+}
+
+// Remove forgets the keys of the peer with the given public key.
+func (r *PresharedKeyRotator) Remove(publicKey NoisePublicKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.keys[publicKey]; ok {
+		setZero(entry.current[:])
+		setZero(entry.previous[:])
+		delete(r.keys, publicKey)
+	}
+}
+
+func (r *PresharedKeyRotator) PresharedKeys(publicKey NoisePublicKey) []NoisePresharedKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.keys[publicKey]
+	if !ok {
+		return nil
+	}
+	if r.clock.Now().Before(entry.previousUntil) {
+		// Respond with the old key while the other side may not have the new one.
+		return []NoisePresharedKey{entry.previous, entry.current}
+	}
+	setZero(entry.previous[:])
+	return []NoisePresharedKey{entry.current}
+}
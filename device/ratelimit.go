@@ -0,0 +1,46 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/ratelimiter"
+)
+
+// A HandshakeLimiter decides which handshake messages with a valid MAC2 to
+// process while the device is under load. The default is a
+// ratelimiter.Ratelimiter, configured with SetHandshakeRateLimit.
+type HandshakeLimiter interface {
+	// Allow reports whether to process a message from ip. It is called by
+	// the handshake workers concurrently, for every such message.
+	Allow(ip netip.Addr) bool
+}
+
+var _ HandshakeLimiter = (*ratelimiter.Ratelimiter)(nil)
+
+// SetHandshakeLimiter replaces the built-in rate limiter with limiter.
+// Passing nil restores the built-in one.
+func (device *Device) SetHandshakeLimiter(limiter HandshakeLimiter) {
+	device.rate.Lock()
+	defer device.rate.Unlock()
+	device.rate.custom = limiter
+}
+
+// SetHandshakeRateLimit configures the built-in rate limiter.
+func (device *Device) SetHandshakeRateLimit(config ratelimiter.Config) {
+	device.rate.limiter.SetConfig(config)
+}
+
+func (device *Device) allowHandshake(ip netip.Addr) bool {
+	device.rate.RLock()
+	custom := device.rate.custom
+	device.rate.RUnlock()
+	if custom != nil {
+		return custom.Allow(ip)
+	}
+	return device.rate.limiter.Allow(ip)
+}
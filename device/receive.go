@@ -58,7 +58,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
 		return
 	}
 	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	if keypair != nil && peer.keypairRekeysOnTime(keypair) && peer.device.since(keypair.created) > max(peer.rekeyAfterTime(), peer.rejectAfterTime()-KeepaliveTimeout-RekeyTimeout) {
 		peer.timers.sentLastMinuteHandshake.Store(true)
 		peer.SendHandshakeInitiation(false)
 	}
@@ -127,7 +127,8 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 
 		// handle each packet in the batch
 		for i, size := range sizes[:count] {
-			if size < MinMessageSize {
+			if size < 4 {
+				device.handshakeOffence(endpoints[i], HandshakeFailureMalformed)
 				continue
 			}
 
@@ -136,6 +137,16 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 			packet := bufsArrs[i][:size]
 			msgType := binary.LittleEndian.Uint32(packet[:4])
 
+			if msgType >= MinCustomMessageType {
+				if handler := device.messageHandler(msgType); handler != nil {
+					handler(packet, endpoints[i])
+					continue
+				}
+			} else if size < MinMessageSize {
+				device.handshakeOffence(endpoints[i], HandshakeFailureMalformed)
+				continue
+			}
+
 			switch msgType {
 
 			// check if transport
@@ -145,6 +156,7 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 				// check size
 
 				if len(packet) < MessageTransportSize {
+					device.handshakeOffence(endpoints[i], HandshakeFailureMalformed)
 					continue
 				}
 
@@ -161,7 +173,7 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 
 				// check keypair expiry
 
-				if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+				if keypair.created.Add(value.peer.rejectAfterTime()).Before(device.now()) {
 					continue
 				}
 
@@ -189,34 +201,40 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 
 			case MessageInitiationType:
 				if len(packet) != MessageInitiationSize {
+					device.handshakeOffence(endpoints[i], HandshakeFailureMalformed)
 					continue
 				}
 
 			case MessageResponseType:
 				if len(packet) != MessageResponseSize {
+					device.handshakeOffence(endpoints[i], HandshakeFailureMalformed)
 					continue
 				}
 
 			case MessageCookieReplyType:
 				if len(packet) != MessageCookieReplySize {
+					device.handshakeOffence(endpoints[i], HandshakeFailureMalformed)
 					continue
 				}
 
 			default:
 				device.log.Verbosef("Received message with unknown type")
+				device.handshakeOffence(endpoints[i], HandshakeFailureMalformed)
 				continue
 			}
 
-			select {
-			case device.queue.handshake.c <- QueueHandshakeElement{
+			if device.handshakeSourceBanned(endpoints[i]) {
+				continue
+			}
+
+			if device.queue.handshake.send(device.handshakeClassOf(msgType, endpoints[i]), QueueHandshakeElement{
 				msgType:  msgType,
 				buffer:   bufsArrs[i],
 				packet:   packet,
 				endpoint: endpoints[i],
-			}:
+			}) {
 				bufsArrs[i] = device.GetMessageBuffer()
 				bufs[i] = bufsArrs[i][:]
-			default:
 			}
 		}
 		for peer, elemsContainer := range elemsByPeer {
@@ -275,7 +293,13 @@ func (device *Device) RoutineHandshake(id int) {
 	}()
 	device.log.Verbosef("Routine: handshake worker %d - started", id)
 
-	for elem := range device.queue.handshake.c {
+	for {
+		elem, ok := device.queue.handshake.receive()
+		if !ok {
+			break
+		}
+		var retiring bool          // addressed to the retiring identity
+		var checker *CookieChecker // of the identity it is addressed to
 
 		// handle cookie fields and ratelimiting
 
@@ -302,7 +326,9 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// consume reply
 
-			if peer := entry.peer; peer.isRunning.Load() {
+			if peer := entry.peer; peer.probe != nil {
+				peer.probeDone(ProbeCookieDemanded)
+			} else if peer.isRunning.Load() {
 				device.log.Verbosef("Receiving cookie response from %s", elem.endpoint.DstToString())
 				if !peer.cookieGenerator.ConsumeReply(&reply) {
 					device.log.Verbosef("Could not decrypt invalid cookie response")
@@ -315,9 +341,15 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// check mac fields and maybe ratelimit
 
-			if !device.cookieChecker.CheckMAC1(elem.packet) {
-				device.log.Verbosef("Received packet with invalid mac1")
-				goto skip
+			checker = &device.cookieChecker
+			if !checker.CheckMAC1(elem.packet) {
+				checker = device.retiringCookieChecker(elem.msgType)
+				if checker == nil || !checker.CheckMAC1(elem.packet) {
+					device.handshakeInvalidMAC1(&elem)
+					device.handshakeOffence(elem.endpoint, HandshakeFailureInvalidMAC1)
+					goto skip
+				}
+				retiring = true
 			}
 
 			// endpoints destination address is the source of the datagram
@@ -326,14 +358,16 @@ func (device *Device) RoutineHandshake(id int) {
 
 				// verify MAC2 field
 
-				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
-					device.SendHandshakeCookie(&elem)
+				if !checker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+					device.handshakeFailures[HandshakeFailureMissingMAC2].Add(1)
+					device.handshakeOffence(elem.endpoint, HandshakeFailureMissingMAC2)
+					device.sendHandshakeCookie(&elem, checker)
 					goto skip
 				}
 
 				// check ratelimiter
 
-				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+				if !device.allowHandshake(elem.endpoint.DstIP()) {
 					goto skip
 				}
 			}
@@ -359,12 +393,15 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// consume initiation
 
-			peer := device.ConsumeMessageInitiation(&msg)
-			if peer == nil {
-				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
+			peer, failure := device.consumeMessageInitiation(&msg, retiring, elem.endpoint)
+			if failure != 0 {
+				device.handshakeFailed(peer, failure, "initiation", elem.endpoint)
+				device.handshakeOffence(elem.endpoint, failure)
 				goto skip
 			}
 
+			peer.keepaliveCheckInitiation()
+
 			// update timers
 
 			peer.timersAnyAuthenticatedPacketTraversal()
@@ -372,6 +409,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
+			device.noteAuthenticatedSource(elem.endpoint)
 
 			device.log.Verbosef("%v - Received handshake initiation", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
@@ -389,16 +427,36 @@ func (device *Device) RoutineHandshake(id int) {
 				goto skip
 			}
 
+			// check source before it affects the handshake state
+
+			if entry := device.indexTable.Lookup(msg.Receiver); entry.peer != nil && !entry.peer.endpointAllowed(elem.endpoint) {
+				device.handshakeFailed(entry.peer, HandshakeFailureEndpointNotAllowed, "response", elem.endpoint)
+				device.handshakeOffence(elem.endpoint, HandshakeFailureEndpointNotAllowed)
+				goto skip
+			}
+
 			// consume response
 
-			peer := device.ConsumeMessageResponse(&msg)
-			if peer == nil {
-				device.log.Verbosef("Received invalid response message from %s", elem.endpoint.DstToString())
+			peer, failure := device.consumeMessageResponse(&msg)
+			if peer != nil && peer.probe != nil {
+				if failure != 0 {
+					device.log.Verbosef("%v - Invalid probe response: %v", peer, failure)
+					peer.probeDone(ProbeInvalidResponse)
+				} else {
+					peer.probeDone(0)
+				}
+				goto skip
+			}
+			if failure != 0 {
+				device.handshakeFailed(peer, failure, "response", elem.endpoint)
+				device.handshakeOffence(elem.endpoint, failure)
 				goto skip
 			}
 
 			// update endpoint
 			peer.SetEndpointFromPacket(elem.endpoint)
+			device.noteAuthenticatedSource(elem.endpoint)
+			peer.measureHandshakeRTT(elem.endpoint)
 
 			device.log.Verbosef("%v - Received handshake response", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"time"
+)
+
+// MinRekeyAfterTime is the shortest rekey_after_time a peer may be given.
+const MinRekeyAfterTime = time.Second * 15
+
+var (
+	errRekeyTooLong  = errors.New("exceeds protocol maximum")
+	errRekeyTooShort = errors.New("below minimum")
+)
+
+// rejectTimeFor and rekeyTimeFor scale one time to the other in the ratio of
+// RekeyAfterTime to RejectAfterTime. Both times are at most RejectAfterTime,
+// so the products cannot overflow.
+func rejectTimeFor(rekey time.Duration) time.Duration {
+	return rekey * time.Duration(RejectAfterTime/time.Second) / time.Duration(RekeyAfterTime/time.Second)
+}
+
+func rekeyTimeFor(reject time.Duration) time.Duration {
+	return reject * time.Duration(RekeyAfterTime/time.Second) / time.Duration(RejectAfterTime/time.Second)
+}
+
+// setRekeyAfterTime gives the peer a session lifetime shorter than the
+// protocol's. Limits can only be lowered, never raised, so that the other
+// side, which applies the standard ones, never rejects a session we still
+// consider good. If only one of the two times is set, the other keeps the
+// ratio of RekeyAfterTime to RejectAfterTime. Zero means the default.
+//
+// Limits are read at the time of each check, so a change applies to the
+// current session too.
+func (peer *Peer) setRekeyAfterTime(d time.Duration) error {
+	if d > RekeyAfterTime {
+		return errRekeyTooLong
+	}
+	if d != 0 && d < MinRekeyAfterTime {
+		return errRekeyTooShort
+	}
+	peer.rekey.afterTime.Store(int64(d))
+	return nil
+}
+
+func (peer *Peer) setRejectAfterTime(d time.Duration) error {
+	if d > RejectAfterTime {
+		return errRekeyTooLong
+	}
+	if d != 0 && d < rejectTimeFor(MinRekeyAfterTime) {
+		return errRekeyTooShort
+	}
+	peer.rekey.rejectAfterTime.Store(int64(d))
+	return nil
+}
+
+func (peer *Peer) setRekeyAfterMessages(n uint64) error {
+	if n > RekeyAfterMessages {
+		return errRekeyTooLong
+	}
+	peer.rekey.afterMessages.Store(n)
+	return nil
+}
+
+func (peer *Peer) rekeyAfterTime() time.Duration {
+	rekey := time.Duration(peer.rekey.afterTime.Load())
+	reject := time.Duration(peer.rekey.rejectAfterTime.Load())
+	switch {
+	case rekey == 0 && reject == 0:
+		return RekeyAfterTime
+	case rekey == 0:
+		return rekeyTimeFor(reject)
+	case reject != 0:
+		// Leave time to rekey before the session is rejected.
+		return min(rekey, rekeyTimeFor(reject))
+	}
+	return rekey
+}
+
+func (peer *Peer) rejectAfterTime() time.Duration {
+	if reject := time.Duration(peer.rekey.rejectAfterTime.Load()); reject != 0 {
+		return reject
+	}
+	if rekey := time.Duration(peer.rekey.afterTime.Load()); rekey != 0 {
+		return rejectTimeFor(rekey)
+	}
+	return RejectAfterTime
+}
+
+// rekeyOverridden reports whether the peer has a session lifetime of its
+// own.
+func (peer *Peer) rekeyOverridden() bool {
+	return peer.rekey.afterTime.Load() != 0 || peer.rekey.rejectAfterTime.Load() != 0
+}
+
+// keypairRekeysOnTime reports whether we start a new handshake once keypair
+// is older than rekeyAfterTime. The protocol leaves that to the initiator of
+// the session, but a peer with a session lifetime of its own is rekeyed from
+// this side whichever side initiated, as the other side keeps to the
+// standard times, and its sessions are rejected after rejectAfterTime either
+// way.
+func (peer *Peer) keypairRekeysOnTime(keypair *Keypair) bool {
+	return keypair.isInitiator || peer.rekeyOverridden()
+}
+
+func (peer *Peer) rekeyAfterMessages() uint64 {
+	if n := peer.rekey.afterMessages.Load(); n != 0 {
+		return n
+	}
+	return RekeyAfterMessages
+}
+
+// rekeyAfterBytes reports whether keypair has been used to send as many
+// bytes as the peer allows for a session.
+func (peer *Peer) rekeyAfterBytes(keypair *Keypair) bool {
+	limit := peer.rekey.afterBytes.Load()
+	return limit != 0 && peer.txBytes.Load()-keypair.txBytesBase >= limit
+}
@@ -0,0 +1,33 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+// RelayFallbackAttempts is the number of unanswered handshake retries after
+// which a peer falls back to the relay.
+const RelayFallbackAttempts = 2
+
+// fallBackToRelay switches the peer onto the relay path, if it has one and
+// is not on it already. While relayed, every handshake initiation is also
+// sent to the direct endpoint (see sendInitiationToAlternatives), and a
+// response that comes back directly moves the peer back. Since an initiator
+// rekeys at least every RekeyAfterTime, a restored direct path is noticed
+// within a couple of minutes at most. Moving onto the relay is a roam, so a
+// peer that may not roam stays on its direct endpoint.
+func (peer *Peer) fallBackToRelay() {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if peer.endpoint.relay == nil || peer.endpoint.viaRelay || !peer.mayUseRelayLocked() {
+		return
+	}
+	peer.device.log.Verbosef("%v - Direct path not responding, falling back to relay", peer)
+	peer.endpoint.viaRelay = true
+}
+
+// mayUseRelayLocked reports whether the roaming policy of the peer lets it
+// move onto the relay. The caller must hold peer.endpoint.
+func (peer *Peer) mayUseRelayLocked() bool {
+	return !peer.endpoint.disableRoaming && peer.endpoint.roaming != roamingOff
+}
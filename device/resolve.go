@@ -0,0 +1,250 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	EndpointResolveAttempts    = 3 // unanswered handshake retries before resolving endpoint names again
+	EndpointResolveTimeout     = time.Second * 10
+	DefaultEndpointResolveTTL  = time.Minute * 5 // how long resolved names are used when the resolver does not know
+	MinEndpointResolveInterval = time.Second * 30
+)
+
+// An EndpointResolver resolves endpoint names for a Device. An endpoint may
+// be given as a name rather than a literal address, either as host:port,
+// which is resolved to A and AAAA records, or as an SRV name such as
+// _wireguard._udp.example.com, whose targets supply the ports. All
+// resulting addresses become endpoint candidates. Names are resolved in the
+// background, never while configuring the device, and again when the
+// resolver's TTL runs out, or early when handshakes stop completing.
+type EndpointResolver interface {
+	// ResolveEndpoint resolves name, which is either host:port or an SRV
+	// name, to addresses in order of preference, and reports how long the
+	// result may be used before resolving it again.
+	ResolveEndpoint(ctx context.Context, name string) (addrs []netip.AddrPort, ttl time.Duration, err error)
+}
+
+// NetResolver is an EndpointResolver using a net.Resolver. As the net
+// package does not expose record TTLs, results are assumed to be valid for
+// DefaultEndpointResolveTTL.
+type NetResolver struct {
+	Resolver *net.Resolver // nil means net.DefaultResolver
+}
+
+func (r *NetResolver) ResolveEndpoint(ctx context.Context, name string) ([]netip.AddrPort, time.Duration, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	var targets []netip.AddrPort
+	var hosts []string
+	var ports []uint16
+	if host, port, err := net.SplitHostPort(name); err == nil {
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, 0, err
+		}
+		hosts = append(hosts, host)
+		ports = append(ports, uint16(portNum))
+	} else {
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, srv := range srvs {
+			hosts = append(hosts, srv.Target)
+			ports = append(ports, srv.Port)
+		}
+	}
+	for i, host := range hosts {
+		addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			targets = append(targets, netip.AddrPortFrom(addr.Unmap(), ports[i]))
+		}
+	}
+	if len(targets) == 0 {
+		return nil, 0, errors.New("no addresses found for " + name)
+	}
+	return targets, DefaultEndpointResolveTTL, nil
+}
+
+// SetEndpointResolver sets the resolver used for endpoint names.
+// Passing nil restores the default NetResolver.
+func (device *Device) SetEndpointResolver(resolver EndpointResolver) {
+	device.resolver.Lock()
+	defer device.resolver.Unlock()
+	device.resolver.r = resolver
+}
+
+func (device *Device) endpointResolver() EndpointResolver {
+	device.resolver.RLock()
+	defer device.resolver.RUnlock()
+	if device.resolver.r == nil {
+		return &NetResolver{}
+	}
+	return device.resolver.r
+}
+
+// isEndpointName reports whether s names an endpoint, rather than being a
+// literal address or plain garbage.
+func isEndpointName(s string) bool {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		_, err = netip.ParseAddr(host)
+		return err != nil && host != ""
+	}
+	return strings.HasPrefix(s, "_") && strings.Contains(s, ".")
+}
+
+// resolveEndpoints turns endpoint specifications, each a literal address or
+// a name, into endpoints, and reports when any names should be resolved
+// again. At most MaxEndpointCandidates endpoints are returned.
+func (device *Device) resolveEndpoints(specs []string) (endpoints []conn.Endpoint, ttl time.Duration, err error) {
+	ttl = DefaultEndpointResolveTTL
+	var addrs []string
+	for _, spec := range specs {
+		if !isEndpointName(spec) {
+			addrs = append(addrs, spec)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), EndpointResolveTimeout)
+		resolved, resolvedTTL, err := device.endpointResolver().ResolveEndpoint(ctx, spec)
+		cancel()
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = min(ttl, resolvedTTL)
+		for _, addr := range resolved {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errors.New("no endpoints")
+	}
+	addrs = addrs[:min(len(addrs), MaxEndpointCandidates)]
+
+	device.net.RLock()
+	defer device.net.RUnlock()
+	for _, addr := range addrs {
+		endpoint, err := device.net.bind.ParseEndpoint(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, max(ttl, MinEndpointResolveInterval), nil
+}
+
+// resolveEndpointAsync resolves the peer's endpoint names again in the
+// background. If a resolution is already underway, it is repeated once
+// done should the names have changed meanwhile.
+func (peer *Peer) resolveEndpointAsync() {
+	peer.endpoint.Lock()
+	hasNames := len(peer.endpoint.names) > 0
+	peer.endpoint.Unlock()
+	if !hasNames {
+		return
+	}
+	peer.resolveAgain.Store(true)
+	if !peer.resolving.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		for {
+			for peer.resolveAgain.Swap(false) {
+				peer.resolveEndpoint()
+			}
+			peer.resolving.Store(false)
+			if !peer.resolveAgain.Load() || !peer.resolving.CompareAndSwap(false, true) {
+				return
+			}
+		}
+	}()
+}
+
+func (peer *Peer) resolveEndpoint() {
+	peer.endpoint.Lock()
+	names := peer.endpoint.names
+	peer.endpoint.Unlock()
+	if len(names) == 0 {
+		return
+	}
+
+	candidates, ttl, err := peer.device.resolveEndpoints(names)
+	if err != nil {
+		peer.device.log.Verbosef("%v - Failed to resolve endpoint: %v", peer, err)
+		ttl = MinEndpointResolveInterval
+	}
+
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	if !slices.Equal(peer.endpoint.names, names) {
+		// Reconfigured while we were resolving; the new names are next.
+		return
+	}
+	if err == nil {
+		peer.applyResolvedEndpointsLocked(candidates)
+	}
+	peer.endpoint.resolveTTL = ttl
+	peer.timersEndpointResolved(ttl)
+}
+
+// applyResolvedEndpointsLocked replaces the peer's candidates with freshly
+// resolved ones. An endpoint learned from authenticated traffic is kept, the
+// peer only moving to the new candidates should its handshakes fail over.
+// A configured endpoint is kept only if it is among the new candidates. The
+// caller must hold peer.endpoint.
+func (peer *Peer) applyResolvedEndpointsLocked(candidates []conn.Endpoint) {
+	val := peer.endpoint.val
+	if val != nil && slices.Equal(endpointSet(peer.endpoint.candidates), endpointSet(candidates)) {
+		return
+	}
+
+	peer.endpoint.candidates = candidates
+	if val != nil {
+		for i, candidate := range candidates {
+			if candidate.DstToString() == val.DstToString() {
+				// Keep the old endpoint, which may have a sticky source address.
+				candidates[i] = val
+				return
+			}
+		}
+		if peer.endpoint.learned {
+			return
+		}
+		peer.device.log.Verbosef("%v - Endpoint %s no longer resolves, switching to %s", peer, val.DstToString(), candidates[0].DstToString())
+	}
+	peer.endpoint.val = candidates[0]
+	peer.endpoint.learned = false
+	peer.endpoint.clearSrcOnTx = false
+	peer.endpoint.viaRelay = false
+	peer.endpoint.roamPending = nil
+}
+
+// endpointSet returns the addresses of endpoints, sorted.
+func endpointSet(endpoints []conn.Endpoint) []string {
+	addrs := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		addrs[i] = endpoint.DstToString()
+	}
+	slices.Sort(addrs)
+	return addrs
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A roamingMode limits which sources of authenticated packets a peer roams
+// to. By default it roams to any; the roaming= key limits this per peer, to
+// never, or only within the address family of the current endpoint.
+// Together with roaming_threshold=, which makes a peer roam only once that
+// many consecutive authenticated packets have arrived from the new address,
+// this keeps a stray packet, say a replayed one that still falls within the
+// window, from pulling the peer away. Roams are counted as accepted or
+// suppressed; packets waiting on the threshold are neither.
+type roamingMode uint32
+
+const (
+	roamingOn roamingMode = iota
+	roamingOff
+	roamingSameFamily
+)
+
+func (mode roamingMode) String() string {
+	switch mode {
+	case roamingOn:
+		return "on"
+	case roamingOff:
+		return "off"
+	case roamingSameFamily:
+		return "same_family"
+	}
+	return fmt.Sprintf("roamingMode(%d)", uint32(mode))
+}
+
+func parseRoamingMode(s string) (roamingMode, error) {
+	for _, mode := range []roamingMode{roamingOn, roamingOff, roamingSameFamily} {
+		if s == mode.String() {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid roaming mode: %q", s)
+}
+
+func sameEndpoint(a, b conn.Endpoint) bool {
+	return a.DstIP() == b.DstIP() && bytes.Equal(a.DstToBytes(), b.DstToBytes())
+}
+
+// roamLocked reports whether the peer should move from its current endpoint
+// to endpoint, which an authenticated packet came from, and counts the roam.
+// The caller must hold peer.endpoint.
+func (peer *Peer) roamLocked(endpoint conn.Endpoint) bool {
+	current := peer.endpoint.val
+	if current == nil || sameEndpoint(current, endpoint) {
+		peer.endpoint.roamPending = nil
+		return true
+	}
+
+	switch peer.endpoint.roaming {
+	case roamingOff:
+		peer.roamsSuppressed.Add(1)
+		return false
+	case roamingSameFamily:
+		if current.DstIP().Unmap().Is4() != endpoint.DstIP().Unmap().Is4() {
+			peer.roamsSuppressed.Add(1)
+			return false
+		}
+	}
+
+	if peer.endpoint.roamThreshold > 1 {
+		if pending := peer.endpoint.roamPending; pending != nil && sameEndpoint(pending, endpoint) {
+			peer.endpoint.roamCount++
+		} else {
+			peer.endpoint.roamPending = endpoint
+			peer.endpoint.roamCount = 1
+		}
+		if peer.endpoint.roamCount < peer.endpoint.roamThreshold {
+			return false
+		}
+	}
+
+	peer.endpoint.roamPending = nil
+	peer.roamsAccepted.Add(1)
+	peer.device.log.Verbosef("%v - Roaming from %s to %s", peer, current.DstToString(), endpoint.DstToString())
+	return true
+}
@@ -0,0 +1,170 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// MaxPathEndpoints is the maximum number of endpoints per peer whose path
+// quality is tracked.
+const MaxPathEndpoints = 16
+
+// PathQuality is what has been measured of a path to a peer. The round trip
+// time of each handshake we initiate, from sending the initiation to
+// consuming the response, is a sample of the latency to the peer. Samples
+// are smoothed as TCP does (RFC 6298), and handshake initiations that go
+// unanswered give an estimate of loss. Both are kept for the peer as a whole
+// and for each endpoint they were measured on.
+type PathQuality struct {
+	RTT     time.Duration // smoothed round trip time, or zero if none was measured
+	RTTVar  time.Duration // smoothed mean deviation of the round trip time
+	Loss    float64       // smoothed fraction of handshake initiations unanswered
+	Samples uint64        // round trip times measured
+}
+
+type pathEstimator struct {
+	PathQuality
+	updated time.Time
+}
+
+func (e *pathEstimator) addRTT(rtt time.Duration, now time.Time) {
+	if e.Samples == 0 {
+		e.RTT = rtt
+		e.RTTVar = rtt / 2
+	} else {
+		e.RTTVar = (3*e.RTTVar + (e.RTT - rtt).Abs()) / 4
+		e.RTT = (7*e.RTT + rtt) / 8
+	}
+	e.Samples++
+	e.Loss -= e.Loss / 8
+	e.updated = now
+}
+
+func (e *pathEstimator) addLoss(now time.Time) {
+	e.Loss += (1 - e.Loss) / 8
+	e.updated = now
+}
+
+type pathQuality struct {
+	sync.Mutex
+	total     pathEstimator
+	endpoints map[string]*pathEstimator // by DstToString
+	sentTo    []conn.Endpoint           // where the current initiation was sent
+}
+
+// PathQuality returns the quality of the path to the peer, overall and for
+// each endpoint it was measured on, by address.
+func (peer *Peer) PathQuality() (PathQuality, map[string]PathQuality) {
+	peer.path.Lock()
+	defer peer.path.Unlock()
+	endpoints := make(map[string]PathQuality, len(peer.path.endpoints))
+	for addr, e := range peer.path.endpoints {
+		endpoints[addr] = e.PathQuality
+	}
+	return peer.path.total.PathQuality, endpoints
+}
+
+// endpointPathLocked returns the estimator for endpoint, making room for it
+// if needed. The caller must hold peer.path.
+func (peer *Peer) endpointPathLocked(endpoint conn.Endpoint) *pathEstimator {
+	addr := endpoint.DstToString()
+	if e, ok := peer.path.endpoints[addr]; ok {
+		return e
+	}
+	if peer.path.endpoints == nil {
+		peer.path.endpoints = make(map[string]*pathEstimator)
+	}
+	if len(peer.path.endpoints) >= MaxPathEndpoints {
+		var oldest string
+		for other, e := range peer.path.endpoints {
+			if oldest == "" || e.updated.Before(peer.path.endpoints[oldest].updated) {
+				oldest = other
+			}
+		}
+		delete(peer.path.endpoints, oldest)
+	}
+	e := new(pathEstimator)
+	peer.path.endpoints[addr] = e
+	return e
+}
+
+// measureHandshakeRTT records the round trip time of the handshake whose
+// response was just consumed, received from endpoint.
+func (peer *Peer) measureHandshakeRTT(endpoint conn.Endpoint) {
+	peer.handshake.mutex.RLock()
+	sent := peer.handshake.lastSentInitiation
+	peer.handshake.mutex.RUnlock()
+	if sent.IsZero() {
+		return
+	}
+	now := peer.device.now()
+	rtt := now.Sub(sent)
+	if rtt < 0 {
+		return
+	}
+
+	peer.path.Lock()
+	defer peer.path.Unlock()
+	peer.path.sentTo = nil
+	peer.path.total.addRTT(rtt, now)
+	if endpoint != nil {
+		peer.endpointPathLocked(endpoint).addRTT(rtt, now)
+	}
+}
+
+// notePathInitiation records the endpoints a handshake initiation was sent
+// to, direct, through the relay, or to other candidates, so that loss is
+// charged to them should it go unanswered.
+func (peer *Peer) notePathInitiation(sentTo []conn.Endpoint) {
+	peer.path.Lock()
+	peer.path.sentTo = sentTo
+	peer.path.Unlock()
+}
+
+// notePathLoss records that a handshake initiation went unanswered.
+func (peer *Peer) notePathLoss() {
+	now := peer.device.now()
+
+	peer.path.Lock()
+	defer peer.path.Unlock()
+	peer.path.total.addLoss(now)
+	for _, endpoint := range peer.path.sentTo {
+		peer.endpointPathLocked(endpoint).addLoss(now)
+	}
+	peer.path.sentTo = nil
+}
+
+// sendPathQuality serializes the path quality of peer for a UAPI get.
+func sendPathQuality(sendf func(format string, args ...any), peer *Peer) {
+	total, endpoints := peer.PathQuality()
+	if total.Samples != 0 {
+		sendf("rtt_us=%d", total.RTT/time.Microsecond)
+		sendf("rtt_var_us=%d", total.RTTVar/time.Microsecond)
+	}
+	if total.Samples != 0 || total.Loss != 0 {
+		sendf("loss_ppm=%d", int(total.Loss*1e6))
+	}
+	addrs := make([]string, 0, len(endpoints))
+	for addr := range endpoints {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+	for _, addr := range addrs {
+		sendf("path=%s", formatPathQuality(addr, endpoints[addr]))
+	}
+}
+
+// formatPathQuality formats the quality of the path to addr as
+// "addr,rtt_us,rtt_var_us,loss_ppm".
+func formatPathQuality(addr string, q PathQuality) string {
+	return fmt.Sprintf("%s,%d,%d,%d", addr, q.RTT/time.Microsecond, q.RTTVar/time.Microsecond, int(q.Loss*1e6))
+}
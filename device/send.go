@@ -11,7 +11,6 @@ import (
 	"net"
 	"os"
 	"sync"
-	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
@@ -96,23 +95,26 @@ func (peer *Peer) SendKeepalive() {
 }
 
 func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
-	if !isRetry {
+	if peer.backoff.passive.Load() {
+		return nil
+	}
+	if !isRetry && !peer.backingOff() {
 		peer.timers.handshakeAttempts.Store(0)
 	}
 
 	peer.handshake.mutex.RLock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.since(peer.handshake.lastSentHandshake) < peer.handshakeRetryDelay() {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.device.since(peer.handshake.lastSentHandshake) < peer.handshakeRetryDelay() {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
 	peer.device.log.Verbosef("%v - Sending handshake initiation", peer)
@@ -130,10 +132,16 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
-	err = peer.SendBuffers([][]byte{packet})
+	endpoint, err := peer.sendBuffers([][]byte{packet})
 	if err != nil {
 		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
+		endpoint = nil
 	}
+	sentTo := peer.sendInitiationToAlternatives(packet, isRetry)
+	if endpoint != nil {
+		sentTo = append(sentTo, endpoint)
+	}
+	peer.notePathInitiation(sentTo)
 	peer.timersHandshakeInitiated()
 
 	return err
@@ -141,7 +149,7 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 
 func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.device.now()
 	peer.handshake.mutex.Unlock()
 
 	peer.device.log.Verbosef("%v - Sending handshake response", peer)
@@ -175,10 +183,14 @@ func (peer *Peer) SendHandshakeResponse() error {
 }
 
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
+	return device.sendHandshakeCookie(initiatingElem, &device.cookieChecker)
+}
+
+func (device *Device) sendHandshakeCookie(initiatingElem *QueueHandshakeElement, checker *CookieChecker) error {
 	device.log.Verbosef("Sending cookie response for denied handshake message for %v", initiatingElem.endpoint.DstToString())
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
-	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
+	reply, err := checker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
 	if err != nil {
 		device.log.Errorf("Failed to create cookie reply: %v", err)
 		return err
@@ -198,7 +210,7 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := keypair.sendNonce.Load()
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > peer.rekeyAfterMessages() || peer.rekeyAfterBytes(keypair) || (peer.keypairRekeysOnTime(keypair) && peer.device.since(keypair.created) > peer.rekeyAfterTime()) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
@@ -341,7 +353,7 @@ top:
 	}
 
 	keypair := peer.keypairs.Current()
-	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || time.Since(keypair.created) >= RejectAfterTime {
+	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || peer.device.since(keypair.created) >= peer.rejectAfterTime() {
 		peer.SendHandshakeInitiation(false)
 		return
 	}
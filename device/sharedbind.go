@@ -0,0 +1,306 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A SharedBind lets several devices, each with its own static identity,
+// peers and TUN device, listen on one UDP port. Each device is created with
+// its own bind from SharedBind.NewBind, through which they all share the
+// underlying bind and an IndexTable, so that receiver indices are unique
+// among them.
+//
+// Messages received are demultiplexed: responses, cookie replies and
+// transport messages go to the device owning the receiver index they carry,
+// found with a single lookup in the shared IndexTable. An initiation carries
+// no receiver index, only a MAC1 keyed by the public key of its responder,
+// so it goes to the open device whose key verifies it. Messages of a custom
+// type go to the first device with a handler for it. Messages that match no
+// open device are dropped.
+type SharedBind struct {
+	bind       conn.Bind
+	indexTable IndexTable
+
+	mu   sync.Mutex // serializes Open and Close
+	open atomic.Pointer[sharedBindConns]
+	port uint16 // port bind is open on, if any conns are open
+
+	buffers sync.Pool
+}
+
+// sharedBindConns are the open conns of a SharedBind, with the channels
+// they were opened with. They are replaced rather than modified, so that
+// they can be read without locking.
+type sharedBindConns struct {
+	conns    []sharedBindOpen
+	byDevice map[*Device]*sharedBindOpen
+}
+
+type sharedBindOpen struct {
+	*sharedBindConn
+	packets chan<- sharedPacket
+}
+
+// NewSharedBind returns a SharedBind sharing bind.
+func NewSharedBind(bind conn.Bind) *SharedBind {
+	shared := &SharedBind{bind: bind}
+	shared.indexTable.Init()
+	shared.buffers.New = func() any {
+		return new([MaxMessageSize]byte)
+	}
+	return shared
+}
+
+// NewBind returns a bind for a new device on the shared bind. It must be
+// passed to NewDevice, and not used for more than one device.
+func (shared *SharedBind) NewBind() conn.Bind {
+	return &sharedBindConn{shared: shared}
+}
+
+// setOpenLocked replaces the open conns with those of conns that are open.
+// The caller must hold shared.mu.
+func (shared *SharedBind) setOpenLocked(conns []*sharedBindConn) {
+	open := &sharedBindConns{byDevice: make(map[*Device]*sharedBindOpen)}
+	for _, c := range conns {
+		if c.packets != nil {
+			open.conns = append(open.conns, sharedBindOpen{c, c.packets})
+		}
+	}
+	for i := range open.conns {
+		if device := open.conns[i].device.Load(); device != nil {
+			open.byDevice[device] = &open.conns[i]
+		}
+	}
+	shared.open.Store(open)
+}
+
+// openConnsLocked returns the open conns. The caller must hold shared.mu.
+func (shared *SharedBind) openConnsLocked() []*sharedBindConn {
+	var conns []*sharedBindConn
+	for _, open := range shared.openConns().conns {
+		conns = append(conns, open.sharedBindConn)
+	}
+	return conns
+}
+
+func (shared *SharedBind) openConns() *sharedBindConns {
+	if open := shared.open.Load(); open != nil {
+		return open
+	}
+	return &sharedBindConns{}
+}
+
+// A sharedBindConn is the bind of one device on a SharedBind.
+type sharedBindConn struct {
+	shared *SharedBind
+	device atomic.Pointer[Device]
+
+	// protected by shared.mu
+	packets chan sharedPacket // packets for the device, or nil if closed
+	closed  chan struct{}     // closed on Close
+}
+
+type sharedPacket struct {
+	buffer *[MaxMessageSize]byte
+	size   int
+	ep     conn.Endpoint
+}
+
+var _ conn.Bind = (*sharedBindConn)(nil)
+
+func (c *sharedBindConn) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	shared := c.shared
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	if c.packets != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	open := shared.openConnsLocked()
+	if len(open) == 0 {
+		fns, actualPort, err := shared.bind.Open(port)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, fn := range fns {
+			go shared.dispatch(fn)
+		}
+		shared.port = actualPort
+	} else if port != 0 && port != shared.port {
+		return nil, 0, fmt.Errorf("shared bind is listening on port %d", shared.port)
+	}
+	c.packets = make(chan sharedPacket, QueueInboundSize)
+	c.closed = make(chan struct{})
+	shared.setOpenLocked(append(open, c))
+	return []conn.ReceiveFunc{c.receiveFunc(c.packets, c.closed)}, shared.port, nil
+}
+
+func (c *sharedBindConn) Close() error {
+	shared := c.shared
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	if c.packets == nil {
+		return nil
+	}
+	close(c.closed)
+	c.packets = nil
+	c.closed = nil
+	shared.setOpenLocked(shared.openConnsLocked())
+	if len(shared.openConns().conns) == 0 {
+		return shared.bind.Close()
+	}
+	return nil
+}
+
+func (c *sharedBindConn) SetMark(mark uint32) error {
+	return c.shared.bind.SetMark(mark)
+}
+
+func (c *sharedBindConn) Send(bufs [][]byte, ep conn.Endpoint) error {
+	return c.shared.bind.Send(bufs, ep)
+}
+
+func (c *sharedBindConn) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return c.shared.bind.ParseEndpoint(s)
+}
+
+func (c *sharedBindConn) BatchSize() int {
+	return c.shared.bind.BatchSize()
+}
+
+func (c *sharedBindConn) receiveFunc(packets chan sharedPacket, closed chan struct{}) conn.ReceiveFunc {
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (n int, err error) {
+		var packet sharedPacket
+		select {
+		case packet = <-packets:
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+		for {
+			sizes[n] = copy(bufs[n], packet.buffer[:packet.size])
+			eps[n] = packet.ep
+			c.shared.buffers.Put(packet.buffer)
+			n++
+			if n == len(bufs) {
+				return n, nil
+			}
+			select {
+			case packet = <-packets:
+			default:
+				return n, nil
+			}
+		}
+	}
+}
+
+// dispatch receives packets with recv and passes them to the devices they
+// are for, until the bind is closed. Packets are received into buffers from
+// the pool, which are handed over to the device as they are, so that each
+// packet is copied only once more, into the buffers of the device.
+func (shared *SharedBind) dispatch(recv conn.ReceiveFunc) {
+	batchSize := shared.bind.BatchSize()
+	buffers := make([]*[MaxMessageSize]byte, batchSize)
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		buffers[i] = shared.buffers.Get().(*[MaxMessageSize]byte)
+		bufs[i] = buffers[i][:]
+	}
+	defer func() {
+		for _, buffer := range buffers {
+			shared.buffers.Put(buffer)
+		}
+	}()
+	sizes := make([]int, batchSize)
+	eps := make([]conn.Endpoint, batchSize)
+	var deathSpiral int
+
+	for {
+		count, err := recv(bufs, sizes, eps)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if neterr, ok := err.(net.Error); ok && !neterr.Temporary() {
+				return
+			}
+			if deathSpiral < 10 {
+				deathSpiral++
+				time.Sleep(time.Second / 3)
+				continue
+			}
+			return
+		}
+		deathSpiral = 0
+
+		open := shared.openConns()
+		for i := 0; i < count; i++ {
+			c := open.route(bufs[i][:sizes[i]], &shared.indexTable)
+			if c == nil {
+				continue
+			}
+			select {
+			case c.packets <- sharedPacket{buffer: buffers[i], size: sizes[i], ep: eps[i]}:
+				buffers[i] = shared.buffers.Get().(*[MaxMessageSize]byte)
+				bufs[i] = buffers[i][:]
+			default:
+			}
+		}
+	}
+}
+
+// route returns the conn of the device packet is for, or nil if there is
+// none among the open conns.
+func (open *sharedBindConns) route(packet []byte, indexTable *IndexTable) *sharedBindOpen {
+	if len(packet) < 4 {
+		return nil
+	}
+	var receiverOffset int
+	switch msgType := binary.LittleEndian.Uint32(packet); msgType {
+	case MessageInitiationType:
+		if len(packet) != MessageInitiationSize {
+			return nil
+		}
+		for i := range open.conns {
+			if device := open.conns[i].device.Load(); device != nil && device.checkMAC1(MessageInitiationType, packet) {
+				return &open.conns[i]
+			}
+		}
+		return nil
+	case MessageResponseType:
+		receiverOffset = 8
+	case MessageCookieReplyType, MessageTransportType:
+		receiverOffset = MessageTransportOffsetReceiver
+	default:
+		if msgType < MinCustomMessageType {
+			return nil
+		}
+		for i := range open.conns {
+			if device := open.conns[i].device.Load(); device != nil && device.messageHandler(msgType) != nil {
+				return &open.conns[i]
+			}
+		}
+		return nil
+	}
+	if len(packet) < receiverOffset+4 {
+		return nil
+	}
+	entry := indexTable.Lookup(binary.LittleEndian.Uint32(packet[receiverOffset:]))
+	if entry.peer == nil {
+		return nil
+	}
+	return open.byDevice[entry.peer.device]
+}
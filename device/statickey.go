@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// A StaticKey performs the Diffie-Hellman operations of the static private
+// key of a device, which need not then be held in process memory: it may
+// live in a hardware token or in a separate, more privileged process, such
+// as one served by package keyagent.
+//
+// SharedSecret is called once per peer when the key is set, before device
+// state is locked, and may be called concurrently. It is also called when a
+// peer is added and once per handshake message received, with device state
+// locked, so it should not take long.
+type StaticKey interface {
+	// PublicKey returns the public key, which must not change.
+	PublicKey() NoisePublicKey
+
+	// SharedSecret returns the X25519 shared secret of the private key and
+	// publicKey, or an error if it cannot be computed or is all zeros.
+	SharedSecret(publicKey NoisePublicKey) ([NoisePublicKeySize]byte, error)
+}
+
+// SoftwareStaticKey is a StaticKey computed in process memory, the way
+// SetPrivateKey uses a key.
+type SoftwareStaticKey struct {
+	privateKey NoisePrivateKey
+	publicKey  NoisePublicKey
+}
+
+var _ StaticKey = (*SoftwareStaticKey)(nil)
+
+func NewSoftwareStaticKey(sk NoisePrivateKey) *SoftwareStaticKey {
+	return &SoftwareStaticKey{
+		privateKey: sk,
+		publicKey:  sk.publicKey(),
+	}
+}
+
+func (key *SoftwareStaticKey) PublicKey() NoisePublicKey {
+	return key.publicKey
+}
+
+func (key *SoftwareStaticKey) SharedSecret(pk NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	return key.privateKey.sharedSecret(pk)
+}
+
+// clear zeroes the private key once the device no longer uses it.
+func (key *SoftwareStaticKey) clear() {
+	setZero(key.privateKey[:])
+}
+
+// SetStaticKey is like SetPrivateKey, for a key held elsewhere. The private
+// key is then not reported by UAPI.
+func (device *Device) SetStaticKey(key StaticKey) error {
+	return device.setStaticKey(key, 0)
+}
+
+// A StaticKeyBind is a conn.Bind that acts on behalf of the device's static
+// key, such as one registering with a relay server under the device's public
+// key. The device passes it the key whenever the key is set, and nil when it
+// is removed. SetStaticKey is called with device state locked, so it should
+// only take note of the key.
+type StaticKeyBind interface {
+	conn.Bind
+	SetStaticKey(key StaticKey)
+}
+
+var errNoStaticKey = errors.New("no private key set")
+
+func staticSharedSecret(key StaticKey, pk NoisePublicKey) (ss [NoisePublicKeySize]byte, err error) {
+	if key == nil {
+		return ss, errNoStaticKey
+	}
+	return key.SharedSecret(pk)
+}
@@ -19,7 +19,7 @@ func fastrandn(n uint32) uint32
 // A Timer manages time-based aspects of the WireGuard protocol.
 // Timer roughly copies the interface of the Linux kernel's struct timer_list.
 type Timer struct {
-	*time.Timer
+	ClockTimer
 	modifyingLock sync.RWMutex
 	runningLock   sync.Mutex
 	isPending     bool
@@ -27,7 +27,7 @@ type Timer struct {
 
 func (peer *Peer) NewTimer(expirationFunction func(*Peer)) *Timer {
 	timer := &Timer{}
-	timer.Timer = time.AfterFunc(time.Hour, func() {
+	timer.ClockTimer = peer.device.clock.AfterFunc(time.Hour, func() {
 		timer.runningLock.Lock()
 		defer timer.runningLock.Unlock()
 
@@ -77,6 +77,9 @@ func (peer *Peer) timersActive() bool {
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
+	peer.notePathLoss()
+	peer.backoff.failures.Add(1)
+
 	if peer.timers.handshakeAttempts.Load() > MaxTimerHandshakes {
 		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
 
@@ -93,15 +96,30 @@ func expiredRetransmitHandshake(peer *Peer) {
 		 * of a partial exchange.
 		 */
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
-			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+			peer.timers.zeroKeyMaterial.Mod(peer.rejectAfterTime() * 3)
 		}
 	} else {
 		peer.timers.handshakeAttempts.Add(1)
-		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), peer.timers.handshakeAttempts.Load()+1)
+		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(peer.handshakeRetryDelay().Seconds()), peer.timers.handshakeAttempts.Load()+1)
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.markEndpointSrcForClearing()
 
+		/* Perhaps the name of the endpoint points somewhere else by now. */
+		if peer.timers.handshakeAttempts.Load() == EndpointResolveAttempts {
+			peer.resolveEndpointAsync()
+		}
+
+		/* If the current endpoint keeps failing, move on to the next candidate. */
+		if peer.timers.handshakeAttempts.Load()%EndpointFailoverAttempts == 0 {
+			peer.failOverEndpoint()
+		}
+
+		/* If the direct path keeps failing, try the relay, if there is one. */
+		if peer.timers.handshakeAttempts.Load() >= RelayFallbackAttempts {
+			peer.fallBackToRelay()
+		}
+
 		peer.SendHandshakeInitiation(true)
 	}
 }
@@ -124,12 +142,17 @@ func expiredNewHandshake(peer *Peer) {
 }
 
 func expiredZeroKeyMaterial(peer *Peer) {
-	peer.device.log.Verbosef("%s - Removing all keys, since we haven't received a new one in %d seconds", peer, int((RejectAfterTime * 3).Seconds()))
+	peer.device.log.Verbosef("%s - Removing all keys, since we haven't received a new one in %d seconds", peer, int((peer.rejectAfterTime() * 3).Seconds()))
 	peer.ZeroAndFlushAll()
 }
 
+func expiredResolveEndpoint(peer *Peer) {
+	peer.resolveEndpointAsync()
+}
+
 func expiredPersistentKeepalive(peer *Peer) {
-	if peer.persistentKeepaliveInterval.Load() > 0 {
+	if peer.keepaliveInterval() > 0 {
+		peer.keepaliveIntervalPassed()
 		peer.SendKeepalive()
 	}
 }
@@ -161,6 +184,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketSent() {
 
 /* Should be called after any type of authenticated packet is received -- keepalive, data, or handshake. */
 func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
+	peer.keepaliveReceived()
 	if peer.timersActive() {
 		peer.timers.newHandshake.Del()
 	}
@@ -169,7 +193,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
-		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		peer.timers.retransmitHandshake.Mod(peer.nextHandshakeRetryDelay() + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
@@ -180,21 +204,29 @@ func (peer *Peer) timersHandshakeComplete() {
 	}
 	peer.timers.handshakeAttempts.Store(0)
 	peer.timers.sentLastMinuteHandshake.Store(false)
-	peer.lastHandshakeNano.Store(time.Now().UnixNano())
+	peer.resetHandshakeBackoff()
+	peer.lastHandshakeNano.Store(peer.device.now().UnixNano())
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
 func (peer *Peer) timersSessionDerived() {
 	if peer.timersActive() {
-		peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+		peer.timers.zeroKeyMaterial.Mod(peer.rejectAfterTime() * 3)
 	}
 }
 
 /* Should be called before a packet with authentication -- keepalive, data, or handshake -- is sent, or after one is received. */
 func (peer *Peer) timersAnyAuthenticatedPacketTraversal() {
-	keepalive := peer.persistentKeepaliveInterval.Load()
+	keepalive := peer.keepaliveInterval()
 	if keepalive > 0 && peer.timersActive() {
-		peer.timers.persistentKeepalive.Mod(time.Duration(keepalive) * time.Second)
+		peer.timers.persistentKeepalive.Mod(keepalive)
+	}
+}
+
+/* Should be called after endpoint names have been resolved. */
+func (peer *Peer) timersEndpointResolved(ttl time.Duration) {
+	if peer.timersActive() {
+		peer.timers.resolveEndpoint.Mod(ttl)
 	}
 }
 
@@ -204,6 +236,7 @@ func (peer *Peer) timersInit() {
 	peer.timers.newHandshake = peer.NewTimer(expiredNewHandshake)
 	peer.timers.zeroKeyMaterial = peer.NewTimer(expiredZeroKeyMaterial)
 	peer.timers.persistentKeepalive = peer.NewTimer(expiredPersistentKeepalive)
+	peer.timers.resolveEndpoint = peer.NewTimer(expiredResolveEndpoint)
 }
 
 func (peer *Peer) timersStart() {
@@ -218,4 +251,5 @@ func (peer *Peer) timersStop() {
 	peer.timers.newHandshake.DelSync()
 	peer.timers.zeroKeyMaterial.DelSync()
 	peer.timers.persistentKeepalive.DelSync()
+	peer.timers.resolveEndpoint.DelSync()
 }
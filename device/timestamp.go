@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+// TimestampReservation is how far ahead of the clock the bound on handshake
+// timestamps is stored, so that it is not written for every handshake.
+// Timestamps after a restart may run up to that much ahead of the clock.
+const TimestampReservation = time.Minute
+
+// A TimestampStore persists the bound on the handshake timestamps sent by a
+// device. A responder only accepts an initiation whose timestamp is after
+// that of the last one it accepted from the same peer, so the timestamps a
+// device sends never go backwards, even when its clock does; the bound
+// carries that across restarts.
+type TimestampStore interface {
+	// LoadTimestamp returns the bound last stored, or a zero timestamp if
+	// there is none.
+	LoadTimestamp() (tai64n.Timestamp, error)
+
+	// StoreTimestamp stores the bound durably.
+	StoreTimestamp(tai64n.Timestamp) error
+}
+
+// SetTimestampStore makes the device persist the bound on its handshake
+// timestamps to store, and sends no timestamp before the bound stored
+// there. Passing nil stops persisting it.
+func (device *Device) SetTimestampStore(store TimestampStore) error {
+	device.timestamps.Lock()
+	defer device.timestamps.Unlock()
+
+	if store != nil {
+		floor, err := store.LoadTimestamp()
+		if err != nil {
+			return err
+		}
+		if floor.After(device.timestamps.floor) {
+			device.timestamps.floor = floor
+		}
+		device.timestamps.reserved = floor
+	}
+	device.timestamps.store = store
+	return nil
+}
+
+// reserveTimestamps stores a new bound if the one stored leaves less than
+// half of TimestampReservation for the coming handshakes. It is called
+// before handshake state is locked, so that handshakes are not held up by
+// the store.
+func (device *Device) reserveTimestamps() {
+	device.timestamps.storing.Lock()
+	defer device.timestamps.storing.Unlock()
+
+	device.timestamps.Lock()
+	store, floor, reserved := device.timestamps.store, device.timestamps.floor, device.timestamps.reserved
+	device.timestamps.Unlock()
+	now := device.now()
+	if store == nil || reserved.After(tai64n.FromTime(now.Add(TimestampReservation/2))) && reserved.After(floor.Next()) {
+		return
+	}
+
+	// Reserve from the clock rather than from the floor, which may already
+	// be ahead of it after a restart, so that restarts do not push
+	// timestamps ever further ahead.
+	bound := tai64n.FromTime(now.Add(TimestampReservation))
+	if !bound.After(floor) {
+		bound = tai64n.FromTime(floor.Time().Add(TimestampReservation))
+	}
+	if err := store.StoreTimestamp(bound); err != nil {
+		device.log.Errorf("Failed to store handshake timestamp: %v", err)
+		return
+	}
+	device.timestamps.Lock()
+	if device.timestamps.store == store && bound.After(device.timestamps.reserved) {
+		device.timestamps.reserved = bound
+	}
+	device.timestamps.Unlock()
+}
+
+// nextTimestamp returns the timestamp of a new initiation, given the last
+// one sent to the same peer: the current time, unless that is not after
+// every timestamp sent so far. It stays below the bound stored, if it can.
+func (device *Device) nextTimestamp(last tai64n.Timestamp) tai64n.Timestamp {
+	now := device.now()
+	timestamp := tai64n.FromTime(now)
+	if !timestamp.After(last) {
+		timestamp = last.Next()
+	}
+
+	device.timestamps.Lock()
+	defer device.timestamps.Unlock()
+
+	floor := device.timestamps.floor
+	if !timestamp.After(floor) {
+		timestamp = floor.Next()
+	}
+	if reserved := device.timestamps.reserved; device.timestamps.store != nil && !reserved.After(timestamp) {
+		// The bound could not be moved on in time. Timestamps just after
+		// the floor are still accepted, so use those while they last.
+		if next := floor.Next(); reserved.After(next) && next.After(last) {
+			timestamp = next
+		}
+	}
+	device.timestamps.floor = timestamp
+	return timestamp
+}
+
+// FileTimestampStore is a TimestampStore keeping the bound in a file.
+type FileTimestampStore struct {
+	path string
+}
+
+var _ TimestampStore = (*FileTimestampStore)(nil)
+
+func NewFileTimestampStore(path string) *FileTimestampStore {
+	return &FileTimestampStore{path: path}
+}
+
+func (store *FileTimestampStore) LoadTimestamp() (timestamp tai64n.Timestamp, err error) {
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return timestamp, nil
+	}
+	if err != nil {
+		return timestamp, err
+	}
+	if len(data) != tai64n.TimestampSize {
+		return timestamp, errors.New("invalid timestamp file " + store.path)
+	}
+	copy(timestamp[:], data)
+	return timestamp, nil
+}
+
+// StoreTimestamp replaces the file atomically, so that a crash leaves
+// either the old bound or the new one.
+func (store *FileTimestampStore) StoreTimestamp(timestamp tai64n.Timestamp) error {
+	f, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(timestamp[:])
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), store.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -18,7 +18,9 @@ import (
 	"sync"
 	"time"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/ratelimiter"
 )
 
 type IPCError struct {
@@ -97,6 +99,53 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
+		rateConfig := device.rate.limiter.Config()
+		if rateConfig.PacketsPerSecond > 0 {
+			sendf("handshake_rate=%d", rateConfig.PacketsPerSecond)
+		}
+		if rateConfig.PacketsBurstable > 0 {
+			sendf("handshake_burst=%d", rateConfig.PacketsBurstable)
+		}
+		if rateConfig.IPv6PrefixLength > 0 {
+			sendf("handshake_rate_ipv6_prefix=%d", rateConfig.IPv6PrefixLength)
+		}
+		if len(rateConfig.Exempt) > 0 {
+			sendf("handshake_rate_exempt=%s", formatPrefixList(rateConfig.Exempt))
+		}
+
+		loadPolicy := device.LoadPolicy()
+		if loadPolicy.Mode != LoadModeAuto {
+			sendf("load_mode=%v", loadPolicy.Mode)
+		}
+		if loadPolicy.Threshold > 0 {
+			sendf("load_threshold=%d", loadPolicy.Threshold)
+		}
+		if loadPolicy.HoldTime > 0 {
+			sendf("load_hold_time=%d", loadPolicy.HoldTime/time.Second)
+		}
+
+		policy := device.BanPolicy()
+		if policy.Threshold > 0 {
+			sendf("ban_threshold=%d", policy.Threshold)
+		}
+		if policy.Duration > 0 {
+			sendf("ban_time=%d", policy.Duration/time.Second)
+		}
+		if policy.MaxDuration > 0 {
+			sendf("ban_max_time=%d", policy.MaxDuration/time.Second)
+		}
+		now := device.now()
+		for _, ban := range device.Bans() {
+			sendf("ban=%s", formatBan(ban, now))
+		}
+
+		sendHandshakeFailures(sendf, &device.handshakeFailures)
+		for class := range device.queue.handshake.dropped {
+			if n := device.queue.handshake.dropped[class].Load(); n != 0 {
+				sendf("handshake_queue_dropped_%s_count=%d", handshakeClass(class), n)
+			}
+		}
+
 		for _, peer := range device.peers.keyMap {
 			// Serialize peer state.
 			peer.handshake.mutex.RLock()
@@ -105,9 +154,29 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			peer.handshake.mutex.RUnlock()
 			sendf("protocol_version=1")
 			peer.endpoint.Lock()
-			if peer.endpoint.val != nil {
+			// Report every configured endpoint, so that setting what was
+			// got keeps them all, or else where the peer is reached now.
+			switch {
+			case len(peer.endpoint.names) > 0:
+				for _, name := range peer.endpoint.names {
+					sendf("endpoint=%s", name)
+				}
+			case len(peer.endpoint.candidates) > 1:
+				for _, candidate := range peer.endpoint.candidates {
+					sendf("endpoint=%s", candidate.DstToString())
+				}
+			case peer.endpoint.val != nil:
 				sendf("endpoint=%s", peer.endpoint.val.DstToString())
 			}
+			if len(peer.endpoint.allowedIPs) > 0 {
+				sendf("endpoint_allowed_ips=%s", formatPrefixList(peer.endpoint.allowedIPs))
+			}
+			if peer.endpoint.roaming != roamingOn {
+				sendf("roaming=%v", peer.endpoint.roaming)
+			}
+			if peer.endpoint.roamThreshold > 1 {
+				sendf("roaming_threshold=%d", peer.endpoint.roamThreshold)
+			}
 			peer.endpoint.Unlock()
 
 			nano := peer.lastHandshakeNano.Load()
@@ -118,7 +187,46 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("last_handshake_time_nsec=%d", nano)
 			sendf("tx_bytes=%d", peer.txBytes.Load())
 			sendf("rx_bytes=%d", peer.rxBytes.Load())
+			if n := peer.rejectedEndpoints.Load(); n != 0 {
+				sendf("endpoint_rejected_count=%d", n)
+			}
+			if n := peer.roamsAccepted.Load(); n != 0 {
+				sendf("roam_accepted_count=%d", n)
+			}
+			if n := peer.roamsSuppressed.Load(); n != 0 {
+				sendf("roam_suppressed_count=%d", n)
+			}
+			sendHandshakeFailures(sendf, &peer.handshakeFailures)
+			sendPathQuality(sendf, peer)
+			if behind := peer.timestampBehind.Load(); behind != 0 {
+				sendf("handshake_timestamp_behind_ms=%d", behind/int64(time.Millisecond))
+			}
 			sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
+			if peer.keepalive.enabled.Load() {
+				sendf("persistent_keepalive_adaptive=true")
+				sendf("persistent_keepalive_adaptive_interval=%d", peer.keepaliveInterval()/time.Second)
+				peer.keepalive.Lock()
+				sendf("persistent_keepalive_settled=%v", peer.keepalive.settled)
+				peer.keepalive.Unlock()
+			}
+			if d := peer.rekey.afterTime.Load(); d != 0 {
+				sendf("rekey_after_time=%d", d/int64(time.Second))
+			}
+			if d := peer.rekey.rejectAfterTime.Load(); d != 0 {
+				sendf("reject_after_time=%d", d/int64(time.Second))
+			}
+			if n := peer.rekey.afterMessages.Load(); n != 0 {
+				sendf("rekey_after_messages=%d", n)
+			}
+			if n := peer.rekey.afterBytes.Load(); n != 0 {
+				sendf("rekey_after_bytes=%d", n)
+			}
+			if d := peer.backoff.max.Load(); d != 0 {
+				sendf("handshake_backoff_max=%d", d/int64(time.Second))
+			}
+			if peer.backoff.passive.Load() {
+				sendf("passive=true")
+			}
 
 			device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
 				sendf("allowed_ip=%s", prefix.String())
@@ -240,6 +348,100 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		device.log.Verbosef("UAPI: Removing all peers")
 		device.RemoveAllPeers()
 
+	case "handshake_rate", "handshake_burst", "handshake_rate_ipv6_prefix":
+		limit := uint64(1<<31 - 1)
+		switch key {
+		case "handshake_rate":
+			limit = ratelimiter.MaxPacketsPerSecond
+		case "handshake_rate_ipv6_prefix":
+			limit = 128
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err == nil && n > limit {
+			err = fmt.Errorf("greater than %d", limit)
+		}
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse %s: %w", key, err)
+		}
+		config := device.rate.limiter.Config()
+		switch key {
+		case "handshake_rate":
+			config.PacketsPerSecond = int(n)
+		case "handshake_burst":
+			config.PacketsBurstable = int(n)
+		case "handshake_rate_ipv6_prefix":
+			config.IPv6PrefixLength = int(n)
+		}
+		device.log.Verbosef("UAPI: Updating handshake rate limit")
+		device.SetHandshakeRateLimit(config)
+
+	case "handshake_rate_exempt":
+		prefixes, err := parsePrefixList(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set handshake_rate_exempt: %w", err)
+		}
+		config := device.rate.limiter.Config()
+		config.Exempt = prefixes
+		device.log.Verbosef("UAPI: Updating handshake rate limit exemptions")
+		device.SetHandshakeRateLimit(config)
+
+	case "load_mode":
+		mode, err := parseLoadMode(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set load_mode: %w", err)
+		}
+		policy := device.LoadPolicy()
+		policy.Mode = mode
+		device.log.Verbosef("UAPI: Setting load mode %v", mode)
+		device.SetLoadPolicy(policy)
+
+	case "load_threshold", "load_hold_time":
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse %s: %w", key, err)
+		}
+		policy := device.LoadPolicy()
+		if key == "load_threshold" {
+			policy.Threshold = int(n)
+		} else {
+			policy.HoldTime = time.Duration(n) * time.Second
+		}
+		device.log.Verbosef("UAPI: Updating load policy")
+		device.SetLoadPolicy(policy)
+
+	case "ban_threshold", "ban_time", "ban_max_time":
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse %s: %w", key, err)
+		}
+		policy := device.BanPolicy()
+		switch key {
+		case "ban_threshold":
+			policy.Threshold = int(n)
+		case "ban_time":
+			policy.Duration = time.Duration(n) * time.Second
+		case "ban_max_time":
+			policy.MaxDuration = time.Duration(n) * time.Second
+		}
+		device.log.Verbosef("UAPI: Updating ban policy")
+		device.SetBanPolicy(policy)
+
+	case "ban":
+		prefix, d, err := parseBan(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set ban %v: %w", value, err)
+		}
+		device.log.Verbosef("UAPI: Banning %v", prefix)
+		device.Ban(prefix, d)
+
+	case "unban":
+		prefix, _, err := parseBan(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to lift ban %v: %w", value, err)
+		}
+		device.log.Verbosef("UAPI: Lifting ban of %v", prefix)
+		device.Unban(prefix)
+
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
 	}
@@ -253,6 +455,10 @@ type ipcSetPeer struct {
 	dummy   bool // dummy reports whether this peer is a temporary, placeholder peer
 	created bool // new reports whether this is a newly created peer
 	pkaOn   bool // pkaOn reports whether the peer had the persistent keepalive turn on
+
+	endpoints     []conn.Endpoint // endpoints collects repeated endpoint lines of literal addresses
+	endpointSpecs []string        // endpointSpecs are all those lines as given
+	endpointNames bool            // endpointNames reports whether any of them need resolving
 }
 
 func (peer *ipcSetPeer) handlePostConfig() {
@@ -260,7 +466,10 @@ func (peer *ipcSetPeer) handlePostConfig() {
 		return
 	}
 	if peer.created {
-		peer.endpoint.disableRoaming = peer.device.net.brokenRoaming && peer.endpoint.val != nil
+		peer.endpoint.disableRoaming = peer.device.net.brokenRoaming && (peer.endpoint.val != nil || peer.endpointNames)
+	}
+	if peer.endpointNames {
+		peer.resolveEndpointAsync()
 	}
 	if peer.device.isUp() {
 		peer.Start()
@@ -291,6 +500,9 @@ func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error
 	}
 
 	peer.created = peer.Peer == nil
+	peer.endpoints = nil
+	peer.endpointSpecs = nil
+	peer.endpointNames = false
 	if peer.created {
 		peer.Peer, err = device.NewPeer(publicKey)
 		if err != nil {
@@ -339,13 +551,61 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 
 	case "endpoint":
 		device.log.Verbosef("%v - UAPI: Updating endpoint", peer.Peer)
-		endpoint, err := device.net.bind.ParseEndpoint(value)
-		if err != nil {
-			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint %v: %w", value, err)
+		// The first endpoint line replaces all candidates, subsequent ones
+		// append. Names are resolved in the background once the peer is
+		// configured, and contribute no candidates until then.
+		if len(peer.endpointSpecs) >= MaxEndpointCandidates {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint %v: too many endpoints", value)
+		}
+		if isEndpointName(value) {
+			peer.endpointNames = true
+		} else {
+			endpoint, err := device.net.bind.ParseEndpoint(value)
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint %v: %w", value, err)
+			}
+			peer.endpoints = append(peer.endpoints, endpoint)
 		}
+		peer.endpointSpecs = append(peer.endpointSpecs, value)
 		peer.endpoint.Lock()
 		defer peer.endpoint.Unlock()
-		peer.endpoint.val = endpoint
+		peer.setEndpointCandidatesLocked(append([]conn.Endpoint(nil), peer.endpoints...))
+		peer.endpoint.names = nil
+		if peer.endpointNames {
+			peer.endpoint.names = append([]string(nil), peer.endpointSpecs...)
+			peer.endpoint.resolveTTL = MinEndpointResolveInterval
+		}
+
+	case "endpoint_allowed_ips":
+		device.log.Verbosef("%v - UAPI: Updating endpoint allowed IPs", peer.Peer)
+		prefixes, err := parsePrefixList(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set endpoint allowed ips: %w", err)
+		}
+		peer.endpoint.Lock()
+		peer.endpoint.allowedIPs = prefixes
+		peer.endpoint.Unlock()
+
+	case "roaming":
+		device.log.Verbosef("%v - UAPI: Updating roaming mode", peer.Peer)
+		mode, err := parseRoamingMode(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set roaming: %w", err)
+		}
+		peer.endpoint.Lock()
+		peer.endpoint.roaming = mode
+		peer.endpoint.Unlock()
+
+	case "roaming_threshold":
+		device.log.Verbosef("%v - UAPI: Updating roaming threshold", peer.Peer)
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set roaming threshold: %w", err)
+		}
+		peer.endpoint.Lock()
+		peer.endpoint.roamThreshold = uint32(n)
+		peer.endpoint.roamPending = nil
+		peer.endpoint.Unlock()
 
 	case "persistent_keepalive_interval":
 		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
@@ -358,7 +618,52 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		old := peer.persistentKeepaliveInterval.Swap(uint32(secs))
 
 		// Send immediate keepalive if we're turning it on and before it wasn't on.
-		peer.pkaOn = old == 0 && secs != 0
+		peer.pkaOn = old == 0 && secs != 0 && !peer.keepalive.enabled.Load()
+
+	case "persistent_keepalive_adaptive":
+		device.log.Verbosef("%v - UAPI: Updating adaptive persistent keepalive", peer.Peer)
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set adaptive persistent keepalive: %w", err)
+		}
+		wasOff := peer.setAdaptiveKeepalive(enabled)
+		peer.pkaOn = enabled && wasOff && peer.persistentKeepaliveInterval.Load() == 0
+
+	case "handshake_backoff_max":
+		device.log.Verbosef("%v - UAPI: Updating handshake backoff ceiling", peer.Peer)
+		secs, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set handshake backoff ceiling: %w", err)
+		}
+		peer.setHandshakeBackoffMax(time.Duration(secs) * time.Second)
+
+	case "passive":
+		device.log.Verbosef("%v - UAPI: Updating passive mode", peer.Peer)
+		passive, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set passive mode: %w", err)
+		}
+		peer.backoff.passive.Store(passive)
+
+	case "rekey_after_time", "reject_after_time", "rekey_after_messages", "rekey_after_bytes":
+		device.log.Verbosef("%v - UAPI: Updating %s", peer.Peer, key)
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s: %w", key, err)
+		}
+		switch key {
+		case "rekey_after_time":
+			err = peer.setRekeyAfterTime(time.Duration(min(n, uint64(RejectAfterTime/time.Second)+1)) * time.Second)
+		case "reject_after_time":
+			err = peer.setRejectAfterTime(time.Duration(min(n, uint64(RejectAfterTime/time.Second)+1)) * time.Second)
+		case "rekey_after_messages":
+			err = peer.setRekeyAfterMessages(n)
+		case "rekey_after_bytes":
+			peer.rekey.afterBytes.Store(n)
+		}
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s %v: %w", key, value, err)
+		}
 
 	case "replace_allowed_ips":
 		device.log.Verbosef("%v - UAPI: Removing all allowedips", peer.Peer)
@@ -0,0 +1,197 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+const (
+	UnknownPeerTimeout     = time.Second * 5 // how long an UnknownPeerHandler has to answer
+	MaxPendingUnknownPeers = 256             // maximum number of unknown peers being looked up at once
+)
+
+// An UnknownPeerHandler lets a device look peers up on first contact,
+// rather than holding every peer it might ever hear from. It is asked for
+// the configuration of the peer with the given public key, which has sent an
+// authenticated handshake initiation from endpoint but is not configured. It
+// returns the configuration of the peer in the format of the UAPI set
+// operation, as it would follow the public_key line, for instance
+// "allowed_ip=10.0.0.2/32\n", or an error to ignore the initiation. Only
+// keys that configure that one peer are accepted; a configuration with
+// device keys, another public_key, remove or update_only is rejected as a
+// whole. The context is cancelled after UnknownPeerTimeout, after which the
+// result is ignored.
+//
+// Peers added this way stay until the application removes them with
+// RemovePeer or the UAPI, like any other peer. Once the device holds
+// MaxPeers peers, further unknown peers cannot be added.
+type UnknownPeerHandler func(ctx context.Context, publicKey NoisePublicKey, endpoint conn.Endpoint) (string, error)
+
+// SetUnknownPeerHandler sets the handler for initiations from unknown peers.
+// Passing nil drops such initiations, which is the default.
+func (device *Device) SetUnknownPeerHandler(handler UnknownPeerHandler) {
+	device.unknownPeers.Lock()
+	defer device.unknownPeers.Unlock()
+	device.unknownPeers.handler = handler
+}
+
+// handleUnknownInitiator authenticates an initiation from peerPK, which has no
+// peer, and passes it on to the UnknownPeerHandler. chainKey and hash are the
+// handshake state after the static key of msg was decrypted. Checking that
+// the initiator could compute the static-static secret means the handler is
+// only ever asked about keys whose private key the sender holds.
+func (device *Device) handleUnknownInitiator(msg *MessageInitiation, retiring bool, endpoint conn.Endpoint, staticKey StaticKey, peerPK NoisePublicKey, chainKey, hash [blake2s.Size]byte) {
+	device.unknownPeers.Lock()
+	handler := device.unknownPeers.handler
+	_, pending := device.unknownPeers.pending[peerPK]
+	full := len(device.unknownPeers.pending) >= MaxPendingUnknownPeers
+	device.unknownPeers.Unlock()
+	if handler == nil || pending {
+		return
+	}
+	if full {
+		device.log.Verbosef("Dropping initiation from unknown peer: too many pending lookups")
+		return
+	}
+
+	// verify identity
+
+	ss, err := staticSharedSecret(staticKey, peerPK)
+	if err != nil {
+		return
+	}
+	var key [chacha20poly1305.KeySize]byte
+	var timestamp tai64n.Timestamp
+	KDF2(&chainKey, &key, chainKey[:], ss[:])
+	setZero(ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
+	setZero(key[:])
+	setZero(chainKey[:])
+	if err != nil {
+		return
+	}
+
+	device.unknownPeers.Lock()
+	if _, pending := device.unknownPeers.pending[peerPK]; pending {
+		device.unknownPeers.Unlock()
+		return
+	}
+	if device.unknownPeers.pending == nil {
+		device.unknownPeers.pending = make(map[NoisePublicKey]struct{})
+	}
+	device.unknownPeers.pending[peerPK] = struct{}{}
+	device.unknownPeers.Unlock()
+
+	initiation := *msg
+	go device.provisionUnknownPeer(handler, &initiation, retiring, endpoint, peerPK)
+}
+
+// provisionUnknownPeer asks handler for the configuration of peerPK, installs
+// the peer, and consumes msg again, answering it as if it had just arrived.
+// It runs in its own goroutine, as installing a peer takes the same locks as
+// closing the device, which waits for the handshake workers.
+func (device *Device) provisionUnknownPeer(handler UnknownPeerHandler, msg *MessageInitiation, retiring bool, endpoint conn.Endpoint, peerPK NoisePublicKey) {
+	defer func() {
+		device.unknownPeers.Lock()
+		delete(device.unknownPeers.pending, peerPK)
+		device.unknownPeers.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), UnknownPeerTimeout)
+	defer cancel()
+
+	type result struct {
+		config string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		config, err := handler(ctx, peerPK, endpoint)
+		done <- result{config, err}
+	}()
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		res.err = ctx.Err()
+	}
+	if res.err != nil {
+		device.log.Verbosef("Not adding unknown peer from %s: %v", endpoint.DstToString(), res.err)
+		return
+	}
+
+	if err := device.ipcSetUnknownPeer(peerPK, res.config); err != nil {
+		device.log.Errorf("Failed to add unknown peer from %s: %v", endpoint.DstToString(), err)
+		return
+	}
+
+	peer, failure := device.consumeMessageInitiation(msg, retiring, endpoint)
+	if failure != 0 {
+		device.handshakeFailed(peer, failure, "initiation", endpoint)
+		return
+	}
+	device.log.Verbosef("%v - Added unknown peer from %s", peer, endpoint.DstToString())
+
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketReceived()
+	peer.SetEndpointFromPacket(endpoint)
+	peer.rxBytes.Add(MessageInitiationSize)
+	peer.SendHandshakeResponse()
+}
+
+// ipcSetUnknownPeer applies config, as returned by an UnknownPeerHandler, to
+// the peer with public key peerPK, creating it. Unlike IpcSet, it only
+// accepts lines that configure that peer, so that the handler cannot change
+// the device or other peers. If config is rejected, a peer created for it is
+// removed again.
+func (device *Device) ipcSetUnknownPeer(peerPK NoisePublicKey, config string) (err error) {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	peer := new(ipcSetPeer)
+	if err := device.handlePublicKeyLine(peer, hex.EncodeToString(peerPK[:])); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && peer.created && !peer.dummy {
+			device.RemovePeer(peerPK)
+		}
+	}()
+
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q", line)
+		}
+		switch key {
+		case "public_key", "remove", "update_only":
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid key for unknown peer: %v", key)
+		}
+		if err := device.handlePeerLine(peer, key, value); err != nil {
+			return err
+		}
+	}
+	peer.handlePostConfig()
+	return nil
+}
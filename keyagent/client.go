@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package keyagent
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+var errAgentFailed = errors.New("key agent could not compute shared secret")
+
+// Client is a device.StaticKey whose operations are carried out by an agent.
+// Concurrent requests each use their own connection, of which up to MaxConns
+// are kept open; a connection is redialed after any failure.
+type Client struct {
+	dial  func() (net.Conn, error)
+	conns chan struct{} // holds a token for each request in flight
+
+	mu     sync.Mutex // protects idle and closed
+	idle   []net.Conn
+	closed bool
+
+	publicKey device.NoisePublicKey
+}
+
+// Dial connects to the agent listening on the unix socket at path.
+func Dial(path string) (*Client, error) {
+	return NewClient(func() (net.Conn, error) {
+		return net.DialTimeout("unix", path, RequestTimeout)
+	})
+}
+
+// NewClient connects to an agent using dial, and asks it for its public key.
+func NewClient(dial func() (net.Conn, error)) (*Client, error) {
+	client := &Client{
+		dial:  dial,
+		conns: make(chan struct{}, MaxConns),
+	}
+	var zero [32]byte
+	publicKey, err := client.request(OpPublicKey, &zero)
+	if err != nil {
+		return nil, err
+	}
+	client.publicKey = publicKey
+	return client, nil
+}
+
+func (client *Client) PublicKey() device.NoisePublicKey {
+	return client.publicKey
+}
+
+func (client *Client) SharedSecret(pk device.NoisePublicKey) ([32]byte, error) {
+	return client.request(OpSharedSecret, (*[32]byte)(&pk))
+}
+
+func (client *Client) request(op uint32, key *[32]byte) (reply [32]byte, err error) {
+	client.conns <- struct{}{}
+	defer func() { <-client.conns }()
+
+	// A connection that was idle may have been closed by the agent, so
+	// retry once on a fresh one; requests have no side effects.
+	conn := client.get()
+	for retry := conn != nil; ; retry = false {
+		if conn == nil {
+			conn, err = client.dial()
+			if err != nil {
+				return reply, err
+			}
+		}
+		conn.SetDeadline(time.Now().Add(RequestTimeout))
+		err = writeFrame(conn, op, key)
+		var status uint32
+		if err == nil {
+			status, err = readFrame(conn, &reply)
+		}
+		if err != nil {
+			conn.Close()
+			conn = nil
+			if retry {
+				continue
+			}
+			return reply, err
+		}
+		client.put(conn)
+		if status != StatusOK {
+			return reply, errAgentFailed
+		}
+		return reply, nil
+	}
+}
+
+// get returns an idle connection, or nil if there is none.
+func (client *Client) get() net.Conn {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	n := len(client.idle)
+	if n == 0 {
+		return nil
+	}
+	conn := client.idle[n-1]
+	client.idle = client.idle[:n-1]
+	return conn
+}
+
+// put returns conn to the idle connections once a request is done with it.
+func (client *Client) put(conn net.Conn) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		conn.Close()
+		return
+	}
+	client.idle = append(client.idle, conn)
+}
+
+// Close closes the connections to the agent. The Client must not be used
+// afterwards.
+func (client *Client) Close() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.closed = true
+	var err error
+	for _, conn := range client.idle {
+		if e := conn.Close(); err == nil {
+			err = e
+		}
+	}
+	client.idle = nil
+	return err
+}
@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package keyagent lets a device use a static private key held by another
+// process, typically a more privileged one listening on a unix socket, so
+// that the key never enters the memory of the process handling traffic.
+//
+// The agent only ever computes X25519 shared secrets with the key it holds
+// and reports its public key; it never reveals the key itself.
+package keyagent
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Requests and replies are fixed-size frames:
+//
+//	request: 4-byte little-endian op, 32-byte public key (zero for OpPublicKey)
+//	reply:   4-byte little-endian status, 32-byte public or shared key
+const (
+	OpPublicKey    = 1
+	OpSharedSecret = 2
+)
+
+const (
+	StatusOK    = 0
+	StatusError = 1
+)
+
+const (
+	FrameSize      = 4 + 32
+	RequestTimeout = time.Second * 5 // how long the client waits for each reply
+	MaxConns       = 8               // maximum number of connections, and so of requests in flight, of a client
+)
+
+func writeFrame(w io.Writer, code uint32, key *[32]byte) error {
+	var frame [FrameSize]byte
+	binary.LittleEndian.PutUint32(frame[:4], code)
+	copy(frame[4:], key[:])
+	_, err := w.Write(frame[:])
+	return err
+}
+
+func readFrame(r io.Reader, key *[32]byte) (uint32, error) {
+	var frame [FrameSize]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return 0, err
+	}
+	copy(key[:], frame[4:])
+	return binary.LittleEndian.Uint32(frame[:4]), nil
+}
@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package keyagent
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func randKey(t *testing.T) (k [32]byte) {
+	if _, err := rand.Read(k[:]); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestAgent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	key := device.NewSoftwareStaticKey(randKey(t))
+	done := make(chan error)
+	go func() { done <- Serve(l, key) }()
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.PublicKey() != key.PublicKey() {
+		t.Fatal("public key differs from the agent's")
+	}
+	other := device.NewSoftwareStaticKey(randKey(t))
+	want, err := key.SharedSecret(other.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := client.SharedSecret(other.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatal("shared secret differs from the agent's")
+		}
+		// the client redials after losing its connection
+		for _, conn := range client.idle {
+			conn.Close()
+		}
+	}
+	if _, err := client.SharedSecret(device.NoisePublicKey{}); err == nil {
+		t.Error("shared secret with zero public key succeeded")
+	}
+
+	l.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve returned %v after Close", err)
+	}
+}
+
+// barrierKey only computes shared secrets once n requests are waiting for
+// one, so that it fails requests that are not made concurrently.
+type barrierKey struct {
+	device.StaticKey
+	n       int
+	mu      sync.Mutex
+	waiting int
+	ready   chan struct{}
+}
+
+func (key *barrierKey) SharedSecret(pk device.NoisePublicKey) ([32]byte, error) {
+	key.mu.Lock()
+	key.waiting++
+	if key.waiting == key.n {
+		close(key.ready)
+	}
+	key.mu.Unlock()
+	select {
+	case <-key.ready:
+		return key.StaticKey.SharedSecret(pk)
+	case <-time.After(RequestTimeout / 2):
+		return [32]byte{}, errors.New("requests not concurrent")
+	}
+}
+
+func TestAgentConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	key := &barrierKey{
+		StaticKey: device.NewSoftwareStaticKey(randKey(t)),
+		n:         MaxConns,
+		ready:     make(chan struct{}),
+	}
+	go Serve(l, key)
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	other := device.NewSoftwareStaticKey(randKey(t))
+	errs := make(chan error, MaxConns)
+	for i := 0; i < MaxConns; i++ {
+		go func() {
+			_, err := client.SharedSecret(other.PublicKey())
+			errs <- err
+		}()
+	}
+	for i := 0; i < MaxConns; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(client.idle); n != MaxConns {
+		t.Errorf("%d idle connections, want %d", n, MaxConns)
+	}
+}
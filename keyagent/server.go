@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package keyagent
+
+import (
+	"errors"
+	"net"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Serve answers requests on connections accepted from l using key, which is
+// usually a device.SoftwareStaticKey, until l is closed. Access control is
+// left to the listener, for instance the permissions of the socket file.
+func Serve(l net.Listener, key device.StaticKey) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go serveConn(conn, key)
+	}
+}
+
+func serveConn(conn net.Conn, key device.StaticKey) {
+	defer conn.Close()
+
+	for {
+		var pk [32]byte
+		op, err := readFrame(conn, &pk)
+		if err != nil {
+			return
+		}
+		var reply [32]byte
+		status := uint32(StatusOK)
+		switch op {
+		case OpPublicKey:
+			reply = key.PublicKey()
+		case OpSharedSecret:
+			reply, err = key.SharedSecret(pk)
+			if err != nil {
+				status = StatusError
+			}
+		default:
+			status = StatusError
+		}
+		err = writeFrame(conn, status, &reply)
+		for i := range reply {
+			reply[i] = 0
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -30,10 +30,12 @@ const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
 	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+	ENV_WG_TIMESTAMP_FILE     = "WG_TIMESTAMP_FILE"
 )
 
 func printUsage() {
 	fmt.Printf("Usage: %s [-f/--foreground] INTERFACE-NAME\n", os.Args[0])
+	printProbeUsage()
 }
 
 func warning() {
@@ -62,6 +64,9 @@ func main() {
 		fmt.Printf("wireguard-go v%s\n\nUserspace WireGuard daemon for %s-%s.\nInformation available at https://www.wireguard.com.\nCopyright (C) Jason A. Donenfeld <Jason@zx2c4.com>.\n", Version, runtime.GOOS, runtime.GOARCH)
 		return
 	}
+	if len(os.Args) >= 2 && os.Args[1] == "probe" {
+		os.Exit(probeMain(os.Args[2:]))
+	}
 
 	warning()
 
@@ -222,8 +227,20 @@ func main() {
 		return
 	}
 
+	var timestamps device.TimestampStore
+	if path := os.Getenv(ENV_WG_TIMESTAMP_FILE); path != "" {
+		timestamps = device.NewFileTimestampStore(path)
+	}
+
 	device := device.NewDevice(tdev, conn.NewDefaultBind(), logger)
 
+	if timestamps != nil {
+		if err := device.SetTimestampStore(timestamps); err != nil {
+			logger.Errorf("Failed to load handshake timestamp: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
 	logger.Verbosef("Device started")
 
 	errs := make(chan error)
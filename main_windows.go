@@ -25,6 +25,9 @@ const (
 )
 
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "probe" {
+		os.Exit(probeMain(os.Args[2:]))
+	}
 	if len(os.Args) != 2 {
 		os.Exit(ExitSetupFailed)
 	}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+func printProbeUsage() {
+	fmt.Printf("Usage: %s probe PUBLIC-KEY ENDPOINT [PRESHARED-KEY-FILE] < PRIVATE-KEY-FILE\n", os.Args[0])
+}
+
+// probeMain handles the probe subcommand, which checks that the peer with
+// the given public key answers a handshake at the given endpoint, and
+// returns the exit code.
+func probeMain(args []string) int {
+	if len(args) < 2 || len(args) > 3 {
+		printProbeUsage()
+		return ExitSetupFailed
+	}
+	var pk device.NoisePublicKey
+	if err := decodeKey(pk[:], args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid public key: %v\n", err)
+		return ExitSetupFailed
+	}
+	var psk device.NoisePresharedKey
+	if len(args) == 3 {
+		s, err := os.ReadFile(args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read preshared key: %v\n", err)
+			return ExitSetupFailed
+		}
+		if err := decodeKey(psk[:], string(s)); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid preshared key: %v\n", err)
+			return ExitSetupFailed
+		}
+	}
+	var sk device.NoisePrivateKey
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err == nil || (len(line) > 0 && errors.Is(err, io.EOF)) {
+		err = decodeKey(sk[:], line)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid private key: %v\n", err)
+		return ExitSetupFailed
+	}
+
+	logLevel := device.LogLevelError
+	if os.Getenv("LOG_LEVEL") == "verbose" || os.Getenv("LOG_LEVEL") == "debug" {
+		logLevel = device.LogLevelVerbose
+	}
+	bind := conn.NewDefaultBind()
+	endpoint, err := bind.ParseEndpoint(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid endpoint: %v\n", err)
+		return ExitSetupFailed
+	}
+	dev := device.NewDevice(newProbeTUN(), bind, device.NewLogger(logLevel, "(probe) "))
+	defer dev.Close()
+	if err := dev.IpcSet("private_key=" + hex.EncodeToString(sk[:]) + "\n"); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set private key: %v\n", err)
+		return ExitSetupFailed
+	}
+	if err := dev.Up(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to bring up device: %v\n", err)
+		return ExitSetupFailed
+	}
+
+	rtt, err := dev.Probe(context.Background(), pk, psk, endpoint)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[1], err)
+		return ExitSetupFailed
+	}
+	fmt.Printf("%s: handshake completed in %v\n", args[1], rtt)
+	return ExitSetupSuccess
+}
+
+// decodeKey decodes a base64 key, as used by wg(8), into dst.
+func decodeKey(dst []byte, s string) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	if len(key) != len(dst) {
+		return errors.New("wrong key length")
+	}
+	copy(dst, key)
+	return nil
+}
+
+// probeTUN is a TUN device without any packets, for the device that sends
+// probes, which has no peers to route to.
+type probeTUN struct {
+	events chan tun.Event
+	closed chan struct{}
+}
+
+func newProbeTUN() *probeTUN {
+	return &probeTUN{
+		events: make(chan tun.Event),
+		closed: make(chan struct{}),
+	}
+}
+
+func (t *probeTUN) File() *os.File { return nil }
+
+func (t *probeTUN) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	<-t.closed
+	return 0, os.ErrClosed
+}
+
+func (t *probeTUN) Write(bufs [][]byte, offset int) (int, error) { return len(bufs), nil }
+func (t *probeTUN) MTU() (int, error)                            { return device.DefaultMTU, nil }
+func (t *probeTUN) Name() (string, error)                        { return "probe", nil }
+func (t *probeTUN) Events() <-chan tun.Event                     { return t.events }
+func (t *probeTUN) BatchSize() int                               { return 1 }
+
+func (t *probeTUN) Close() error {
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+		close(t.events)
+	}
+	return nil
+}
@@ -12,13 +12,38 @@ import (
 )
 
 const (
-	packetsPerSecond   = 20
-	packetsBurstable   = 5
-	garbageCollectTime = time.Second
-	packetCost         = 1000000000 / packetsPerSecond
-	maxTokens          = packetCost * packetsBurstable
+	DefaultPacketsPerSecond = 20
+	DefaultPacketsBurstable = 5
+	MaxPacketsPerSecond     = 1000000000 // a packet must cost at least a nanosecond of tokens
+	garbageCollectTime      = time.Second
 )
 
+// Config sets the limits of a Ratelimiter. The zero Config gives the
+// defaults.
+type Config struct {
+	PacketsPerSecond int            // zero for DefaultPacketsPerSecond, at most MaxPacketsPerSecond
+	PacketsBurstable int            // zero for DefaultPacketsBurstable
+	IPv6PrefixLength int            // bits of IPv6 sources limited together, zero for all 128
+	Exempt           []netip.Prefix // sources that are never limited
+}
+
+func (config Config) packetsPerSecond() int64 {
+	if config.PacketsPerSecond <= 0 {
+		return DefaultPacketsPerSecond
+	}
+	if config.PacketsPerSecond > MaxPacketsPerSecond {
+		return MaxPacketsPerSecond
+	}
+	return int64(config.PacketsPerSecond)
+}
+
+func (config Config) packetsBurstable() int64 {
+	if config.PacketsBurstable <= 0 {
+		return DefaultPacketsBurstable
+	}
+	return int64(config.PacketsBurstable)
+}
+
 type RatelimiterEntry struct {
 	mu       sync.Mutex
 	lastTime time.Time
@@ -28,6 +53,9 @@ type RatelimiterEntry struct {
 type Ratelimiter struct {
 	mu      sync.RWMutex
 	timeNow func() time.Time
+	config  Config
+	cost    int64 // nanoseconds worth of tokens a packet takes
+	burst   int64 // most tokens an entry holds
 
 	stopReset chan struct{} // send to reset, close to stop
 	table     map[netip.Addr]*RatelimiterEntry
@@ -42,6 +70,38 @@ func (rate *Ratelimiter) Close() {
 	}
 }
 
+// SetClock makes the Ratelimiter take the time from now rather than from
+// time.Now. It may be called before Init, which keeps a clock already set,
+// or after it, but must be called before Allow.
+func (rate *Ratelimiter) SetClock(now func() time.Time) {
+	rate.mu.Lock()
+	defer rate.mu.Unlock()
+	rate.timeNow = now
+}
+
+// SetConfig changes the limits. Sources already being limited keep the
+// tokens they have, up to the new burst.
+func (rate *Ratelimiter) SetConfig(config Config) {
+	config.Exempt = append([]netip.Prefix(nil), config.Exempt...)
+	rate.mu.Lock()
+	defer rate.mu.Unlock()
+	rate.config = config
+	rate.setLimitsLocked()
+}
+
+func (rate *Ratelimiter) Config() Config {
+	rate.mu.RLock()
+	defer rate.mu.RUnlock()
+	config := rate.config
+	config.Exempt = append([]netip.Prefix(nil), config.Exempt...)
+	return config
+}
+
+func (rate *Ratelimiter) setLimitsLocked() {
+	rate.cost = int64(time.Second) / rate.config.packetsPerSecond()
+	rate.burst = rate.cost * rate.config.packetsBurstable()
+}
+
 func (rate *Ratelimiter) Init() {
 	rate.mu.Lock()
 	defer rate.mu.Unlock()
@@ -49,6 +109,7 @@ func (rate *Ratelimiter) Init() {
 	if rate.timeNow == nil {
 		rate.timeNow = time.Now
 	}
+	rate.setLimitsLocked()
 
 	// stop any ongoing garbage collection routine
 	if rate.stopReset != nil {
@@ -98,15 +159,29 @@ func (rate *Ratelimiter) cleanup() (empty bool) {
 
 func (rate *Ratelimiter) Allow(ip netip.Addr) bool {
 	var entry *RatelimiterEntry
+	ip = ip.Unmap()
+
 	// lookup entry
 	rate.mu.RLock()
+	for _, prefix := range rate.config.Exempt {
+		if prefix.Contains(ip) {
+			rate.mu.RUnlock()
+			return true
+		}
+	}
+	if bits := rate.config.IPv6PrefixLength; bits > 0 && ip.Is6() {
+		if prefix, err := ip.Prefix(bits); err == nil {
+			ip = prefix.Addr()
+		}
+	}
 	entry = rate.table[ip]
+	cost, burst := rate.cost, rate.burst
 	rate.mu.RUnlock()
 
 	// make new entry if not found
 	if entry == nil {
 		entry = new(RatelimiterEntry)
-		entry.tokens = maxTokens - packetCost
+		entry.tokens = burst - cost
 		entry.lastTime = rate.timeNow()
 		rate.mu.Lock()
 		rate.table[ip] = entry
@@ -122,13 +197,13 @@ func (rate *Ratelimiter) Allow(ip netip.Addr) bool {
 	now := rate.timeNow()
 	entry.tokens += now.Sub(entry.lastTime).Nanoseconds()
 	entry.lastTime = now
-	if entry.tokens > maxTokens {
-		entry.tokens = maxTokens
+	if entry.tokens > burst {
+		entry.tokens = burst
 	}
 
 	// subtract cost of packet
-	if entry.tokens > packetCost {
-		entry.tokens -= packetCost
+	if entry.tokens > cost {
+		entry.tokens -= cost
 		entry.mu.Unlock()
 		return true
 	}
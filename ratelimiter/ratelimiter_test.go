@@ -32,7 +32,7 @@ func TestRatelimiter(t *testing.T) {
 		)
 	}
 
-	for i := 0; i < packetsBurstable; i++ {
+	for i := 0; i < DefaultPacketsBurstable; i++ {
 		add(result{
 			allowed: true,
 			text:    "initial burst",
@@ -46,7 +46,7 @@ func TestRatelimiter(t *testing.T) {
 
 	add(result{
 		allowed: true,
-		wait:    nano(time.Second.Nanoseconds() / packetsPerSecond),
+		wait:    nano(time.Second.Nanoseconds() / DefaultPacketsPerSecond),
 		text:    "filling tokens for single packet",
 	})
 
@@ -57,7 +57,7 @@ func TestRatelimiter(t *testing.T) {
 
 	add(result{
 		allowed: true,
-		wait:    2 * (nano(time.Second.Nanoseconds() / packetsPerSecond)),
+		wait:    2 * (nano(time.Second.Nanoseconds() / DefaultPacketsPerSecond)),
 		text:    "filling tokens for two packet burst",
 	})
 
@@ -117,3 +117,48 @@ func TestRatelimiter(t *testing.T) {
 		}
 	}
 }
+
+func TestRatelimiterConfig(t *testing.T) {
+	var rate Ratelimiter
+	now := time.Now()
+	rate.SetClock(func() time.Time { return now })
+	rate.Init()
+	defer rate.Close()
+	rate.SetConfig(Config{
+		PacketsPerSecond: 1,
+		PacketsBurstable: 2,
+		IPv6PrefixLength: 64,
+		Exempt:           []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+
+	allowed := func(ip string, n int) (count int) {
+		for i := 0; i < n; i++ {
+			now = now.Add(1)
+			if rate.Allow(netip.MustParseAddr(ip)) {
+				count++
+			}
+		}
+		return count
+	}
+	if got := allowed("192.0.2.1", 5); got != 2 {
+		t.Errorf("allowed %d packets of burst of 2", got)
+	}
+	now = now.Add(time.Second + 1)
+	if got := allowed("192.0.2.1", 5); got != 1 {
+		t.Errorf("allowed %d packets after a second at 1 per second", got)
+	}
+	if got := allowed("2001:db8::1", 1) + allowed("2001:db8::2", 1) + allowed("2001:db8::3", 1); got != 2 {
+		t.Errorf("allowed %d packets from one /64, want burst of 2", got)
+	}
+	if got := allowed("2001:db8:0:1::1", 1); got != 1 {
+		t.Errorf("packet from another /64 not allowed")
+	}
+	if got := allowed("10.1.2.3", 50); got != 50 {
+		t.Errorf("allowed only %d of 50 packets from exempt source", got)
+	}
+
+	rate.SetConfig(Config{PacketsPerSecond: 1<<31 - 1})
+	if got := allowed("192.0.2.2", 50); got != 50 {
+		t.Errorf("allowed only %d of 50 packets at more than MaxPacketsPerSecond", got)
+	}
+}
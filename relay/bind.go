@@ -0,0 +1,233 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package relay
+
+import (
+	"encoding/base64"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// Bind wraps another conn.Bind, sending datagrams for relay endpoints to a
+// relay server and unwrapping datagrams that arrive from it. Datagrams for
+// any other endpoint pass straight through to the wrapped Bind, so a device
+// using it can move between direct and relayed paths on the same socket.
+//
+// A Bind registers under the static key of the device using it, which the
+// device passes it through SetStaticKey, so that it follows the key as it is
+// rotated and works with keys held elsewhere.
+type Bind struct {
+	inner  conn.Bind
+	server conn.Endpoint
+
+	mu       sync.Mutex // protects key, stop and register
+	key      device.StaticKey
+	stop     chan struct{}
+	register chan struct{} // asks routineRegister to register at once
+}
+
+// Endpoint is a peer reached through the relay server.
+type Endpoint struct {
+	server conn.Endpoint
+	key    [32]byte
+}
+
+var (
+	_ conn.Bind            = (*Bind)(nil)
+	_ conn.RelayBind       = (*Bind)(nil)
+	_ device.StaticKeyBind = (*Bind)(nil)
+	_ conn.Endpoint        = (*Endpoint)(nil)
+)
+
+// NewBind returns a Bind that sends through inner and registers with the
+// relay server at server, an address in a form accepted by
+// inner.ParseEndpoint.
+func NewBind(inner conn.Bind, server string) (*Bind, error) {
+	ep, err := inner.ParseEndpoint(server)
+	if err != nil {
+		return nil, err
+	}
+	return &Bind{
+		inner:  inner,
+		server: ep,
+	}, nil
+}
+
+// SetStaticKey sets the key to register under, or stops registering if key
+// is nil. A device using the Bind calls it whenever its key changes.
+func (b *Bind) SetStaticKey(key device.StaticKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.key = key
+	if b.register != nil {
+		select {
+		case b.register <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// staticKey returns the key to register under, or nil if there is none.
+func (b *Bind) staticKey() device.StaticKey {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.key
+}
+
+func (e *Endpoint) ClearSrc() { e.server.ClearSrc() }
+
+func (e *Endpoint) SrcToString() string { return e.server.SrcToString() }
+
+func (e *Endpoint) DstToString() string {
+	return e.server.DstToString() + "/" + base64.StdEncoding.EncodeToString(e.key[:])
+}
+
+// DstToBytes includes the peer's key, so that cookies issued to relayed
+// peers are not shared by everyone behind the same relay.
+func (e *Endpoint) DstToBytes() []byte {
+	return append(e.server.DstToBytes(), e.key[:]...)
+}
+
+func (e *Endpoint) DstIP() netip.Addr { return e.server.DstIP() }
+
+func (e *Endpoint) SrcIP() netip.Addr { return e.server.SrcIP() }
+
+func (b *Bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stop != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	fns, actualPort, err := b.inner.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, fn := range fns {
+		fns[i] = b.makeReceiveFunc(fn)
+	}
+	b.stop = make(chan struct{})
+	b.register = make(chan struct{}, 1)
+	go b.routineRegister(b.stop, b.register)
+	return fns, actualPort, nil
+}
+
+func (b *Bind) Close() error {
+	b.mu.Lock()
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+		b.register = nil
+	}
+	b.mu.Unlock()
+	return b.inner.Close()
+}
+
+func (b *Bind) SetMark(mark uint32) error { return b.inner.SetMark(mark) }
+
+func (b *Bind) BatchSize() int { return b.inner.BatchSize() }
+
+func (b *Bind) ParseEndpoint(s string) (conn.Endpoint, error) { return b.inner.ParseEndpoint(s) }
+
+func (b *Bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	rep, ok := ep.(*Endpoint)
+	if !ok {
+		return b.inner.Send(bufs, ep)
+	}
+	// Relaying is the slow path, so the extra allocation is tolerable.
+	frames := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		frames[i] = make([]byte, FrameHeaderSize+len(buf))
+		putHeader(frames[i], FrameData, &rep.key)
+		copy(frames[i][FrameHeaderSize:], buf)
+	}
+	return b.inner.Send(frames, rep.server)
+}
+
+func (b *Bind) RelayEndpoint(publicKey [32]byte) (conn.Endpoint, error) {
+	return &Endpoint{server: b.server, key: publicKey}, nil
+}
+
+func (b *Bind) IsRelayed(ep conn.Endpoint) bool {
+	_, ok := ep.(*Endpoint)
+	return ok
+}
+
+func (b *Bind) makeReceiveFunc(fn conn.ReceiveFunc) conn.ReceiveFunc {
+	serverIP := b.server.DstIP()
+	serverStr := b.server.DstToString()
+	return func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, err := fn(bufs, sizes, eps)
+		for i := 0; i < n; i++ {
+			if sizes[i] == 0 || eps[i] == nil || eps[i].DstIP() != serverIP || eps[i].DstToString() != serverStr {
+				continue
+			}
+			frameType, key, perr := parseHeader(bufs[i][:sizes[i]])
+			if perr == nil && frameType == FrameChallenge {
+				b.answerChallenge(key, bufs[i][FrameHeaderSize:sizes[i]])
+			}
+			if perr != nil || frameType != FrameData {
+				sizes[i] = 0
+				continue
+			}
+			sizes[i] = copy(bufs[i], bufs[i][FrameHeaderSize:sizes[i]])
+			eps[i] = &Endpoint{server: b.server, key: key}
+		}
+		return n, err
+	}
+}
+
+// answerChallenge registers again, proving to the server, whose public key
+// is serverKey, that we hold our private key.
+func (b *Bind) answerChallenge(serverKey [32]byte, nonce []byte) {
+	if len(nonce) != NonceSize {
+		return
+	}
+	key := b.staticKey()
+	if key == nil {
+		return
+	}
+	shared, err := key.SharedSecret(serverKey)
+	if err != nil {
+		return
+	}
+	publicKey := [32]byte(key.PublicKey())
+	frame := make([]byte, RegisterFrameSize)
+	putHeader(frame, FrameRegister, &publicKey)
+	copy(frame[FrameHeaderSize:], nonce)
+	proof := registerProof(shared[:], &publicKey, nonce)
+	copy(frame[FrameHeaderSize+NonceSize:], proof[:])
+	b.inner.Send([][]byte{frame}, b.server)
+}
+
+// routineRegister asks the server for a challenge every RegisterInterval,
+// and whenever the key changes, keeping our registration fresh as we answer
+// them.
+func (b *Bind) routineRegister(stop, register chan struct{}) {
+	frame := make([]byte, RegisterFrameSize)
+
+	ticker := time.NewTicker(RegisterInterval)
+	defer ticker.Stop()
+	for {
+		// Errors are transient as far as we are concerned; try again next tick.
+		if key := b.staticKey(); key != nil {
+			publicKey := [32]byte(key.PublicKey())
+			putHeader(frame, FrameRegister, &publicKey)
+			b.inner.Send([][]byte{frame}, b.server)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-register:
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package relay implements a minimal datagram relay for WireGuard peers that
+// cannot reach each other directly, along with a conn.Bind that uses it.
+//
+// Clients register with the relay server under their WireGuard public key
+// and address datagrams to other clients by public key. The server rewrites
+// the key in each frame to that of the sender and forwards it. Payloads are
+// WireGuard messages, which are already encrypted and authenticated, so the
+// relay needs no keys of its own and learns nothing beyond which public keys
+// are talking to each other.
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// A frame is a 4-byte little-endian type, laid out like a WireGuard message
+// type, followed by a 32-byte public key and a payload.
+//
+// A register frame carries the public key of the sender and a nonce and
+// MAC proving that the sender holds the matching private key. A server
+// that cannot verify the proof answers with a challenge frame carrying its
+// own public key and a fresh nonce; the client proves possession with a MAC
+// keyed by the Diffie-Hellman of the two keys. A client starts out with an
+// empty proof to get its first challenge.
+//
+// The key of a data frame is the destination when sent to the server, and
+// the source when forwarded by the server.
+const (
+	FrameRegister  = 1
+	FrameData      = 2
+	FrameChallenge = 3
+)
+
+const (
+	FrameHeaderSize     = 4 + 32
+	NonceSize           = 16
+	MACSize             = blake2s.Size128
+	RegisterFrameSize   = FrameHeaderSize + NonceSize + MACSize
+	ChallengeFrameSize  = FrameHeaderSize + NonceSize
+	RegisterInterval    = time.Second * 15 // how often clients refresh their registration
+	RegistrationTimeout = time.Second * 60 // how long the server remembers a registration
+)
+
+var errShortFrame = errors.New("relay frame too short")
+
+func putHeader(b []byte, frameType uint32, key *[32]byte) {
+	binary.LittleEndian.PutUint32(b, frameType)
+	copy(b[4:FrameHeaderSize], key[:])
+}
+
+func parseHeader(b []byte) (frameType uint32, key [32]byte, err error) {
+	if len(b) < FrameHeaderSize {
+		return 0, key, errShortFrame
+	}
+	frameType = binary.LittleEndian.Uint32(b)
+	copy(key[:], b[4:FrameHeaderSize])
+	return frameType, key, nil
+}
+
+// registerProof is the MAC with which the holder of the private key of
+// clientKey answers a challenge of nonce, given shared, the result of
+// Diffie-Hellman between its key and the server's.
+func registerProof(shared []byte, clientKey *[32]byte, nonce []byte) (proof [MACSize]byte) {
+	mac, _ := blake2s.New128(shared)
+	mac.Write(clientKey[:])
+	mac.Write(nonce)
+	mac.Sum(proof[:0])
+	return proof
+}
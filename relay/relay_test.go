@@ -0,0 +1,337 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package relay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func newKeyPair(t *testing.T) (private, public [32]byte) {
+	t.Helper()
+	if _, err := rand.Read(private[:]); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(public[:], pub)
+	return private, public
+}
+
+func startServer(t *testing.T) (*Server, net.PacketConn) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(pc) }()
+	t.Cleanup(func() {
+		pc.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+	})
+	return server, pc
+}
+
+func (s *Server) registered(key [32]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.byKey[key]
+	return ok
+}
+
+// waitRegistered waits for the server to accept the registration of key.
+func waitRegistered(t *testing.T, s *Server, key [32]byte) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !s.registered(key); {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not register")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestRelayForwarding(t *testing.T) {
+	_, pc := startServer(t)
+
+	privA, keyA := newKeyPair(t)
+	privB, keyB := newKeyPair(t)
+	bindA, err := NewBind(conn.NewStdNetBind(), pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindA.SetStaticKey(device.NewSoftwareStaticKey(privA))
+	bindB, err := NewBind(conn.NewStdNetBind(), pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindB.SetStaticKey(device.NewSoftwareStaticKey(privB))
+	fnsA, _, err := bindA.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bindA.Close()
+	fnsB, _, err := bindB.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bindB.Close()
+
+	toB, err := bindA.RelayEndpoint(keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("opaque wireguard message")
+
+	// Challenges are answered as datagrams are received, so bindA must be
+	// read from too.
+	for _, fn := range fnsA {
+		go func(fn conn.ReceiveFunc) {
+			batchSize := bindA.BatchSize()
+			bufs := make([][]byte, batchSize)
+			for i := range bufs {
+				bufs[i] = make([]byte, 1500)
+			}
+			sizes := make([]int, batchSize)
+			eps := make([]conn.Endpoint, batchSize)
+			for {
+				if _, err := fn(bufs, sizes, eps); err != nil {
+					return
+				}
+			}
+		}(fn)
+	}
+
+	// Registrations race with the first sends, so keep sending until
+	// something gets through.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 20)
+		defer ticker.Stop()
+		for {
+			bindA.Send([][]byte{msg}, toB)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	received := make(chan conn.Endpoint, 1)
+	for _, fn := range fnsB {
+		go func(fn conn.ReceiveFunc) {
+			batchSize := bindB.BatchSize()
+			bufs := make([][]byte, batchSize)
+			for i := range bufs {
+				bufs[i] = make([]byte, 1500)
+			}
+			sizes := make([]int, batchSize)
+			eps := make([]conn.Endpoint, batchSize)
+			for {
+				n, err := fn(bufs, sizes, eps)
+				if err != nil {
+					return
+				}
+				for i := 0; i < n; i++ {
+					if sizes[i] == 0 {
+						continue
+					}
+					if !bytes.Equal(bufs[i][:sizes[i]], msg) {
+						t.Errorf("received %q, want %q", bufs[i][:sizes[i]], msg)
+					}
+					select {
+					case received <- eps[i]:
+					default:
+					}
+				}
+			}
+		}(fn)
+	}
+
+	select {
+	case ep := <-received:
+		if !bindB.IsRelayed(ep) {
+			t.Fatalf("source endpoint %v is not relayed", ep.DstToString())
+		}
+		if ep.(*Endpoint).key != keyA {
+			t.Fatal("source endpoint does not identify sender")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("datagram was not relayed")
+	}
+}
+
+func TestRegisterRequiresPrivateKey(t *testing.T) {
+	server, pc := startServer(t)
+	_, victim := newKeyPair(t)
+	attacker, _ := newKeyPair(t)
+
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Ask for a challenge to register the victim's key, then answer it
+	// with a key of our own.
+	frame := make([]byte, RegisterFrameSize)
+	putHeader(frame, FrameRegister, &victim)
+	if _, err := c.WriteTo(frame, pc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, RegisterFrameSize)
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameType, serverKey, err := parseHeader(buf[:n])
+	if err != nil || frameType != FrameChallenge || n != ChallengeFrameSize {
+		t.Fatalf("got frame of type %d and length %d, want a challenge", frameType, n)
+	}
+	shared, err := curve25519.X25519(attacker[:], serverKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(frame[FrameHeaderSize:], buf[FrameHeaderSize:n])
+	proof := registerProof(shared, &victim, buf[FrameHeaderSize:n])
+	copy(frame[FrameHeaderSize+NonceSize:], proof[:])
+	if _, err := c.WriteTo(frame, pc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed proof is answered with a new challenge.
+	if _, _, err := c.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if server.registered(victim) {
+		t.Fatal("server accepted registration without the private key")
+	}
+}
+
+// TestRelayDevices checks that two devices that have no endpoints for each
+// other complete a handshake and exchange data through the relay.
+func TestRelayDevices(t *testing.T) {
+	server, pc := startServer(t)
+
+	var privs, pubs [2][32]byte
+	for i := range privs {
+		privs[i], pubs[i] = newKeyPair(t)
+	}
+	var tuns [2]*tuntest.ChannelTUN
+	var devs [2]*device.Device
+	var ips [2]netip.Addr
+	for i := range tuns {
+		bind, err := NewBind(conn.NewStdNetBind(), pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tuns[i] = tuntest.NewChannelTUN()
+		ips[i] = netip.AddrFrom4([4]byte{1, 0, 0, byte(i + 1)})
+		dev := device.NewDevice(tuns[i].TUN(), bind, device.NewLogger(device.LogLevelVerbose, fmt.Sprintf("dev%d: ", i)))
+		t.Cleanup(dev.Close)
+		devs[i] = dev
+		cfg := fmt.Sprintf("private_key=%s\nlisten_port=0\npublic_key=%s\nallowed_ip=%s/32\n",
+			hex.EncodeToString(privs[i][:]), hex.EncodeToString(pubs[i^1][:]), netip.AddrFrom4([4]byte{1, 0, 0, byte(2 - i)}))
+		if err := dev.IpcSet(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range pubs {
+		waitRegistered(t, server, key)
+	}
+
+	for _, dir := range [][2]int{{0, 1}, {1, 0}} {
+		from, to := dir[0], dir[1]
+		msg := tuntest.Ping(ips[to], ips[from])
+		tuns[from].Outbound <- msg
+		select {
+		case got := <-tuns[to].Inbound:
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("packet from dev%d did not transit correctly", from)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet from dev%d did not transit the relay", from)
+		}
+	}
+
+	// The bind follows the device's key as it is rotated, replacing the
+	// registration of the old key.
+	priv, pub := newKeyPair(t)
+	if err := devs[0].RotatePrivateKey(priv, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	waitRegistered(t, server, pub)
+	if server.registered(pubs[0]) {
+		t.Error("old key still registered after rotation")
+	}
+}
+
+func TestServerRegistrations(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	server.timeNow = func() time.Time { return now }
+	_, keyA := newKeyPair(t)
+	_, keyB := newKeyPair(t)
+	addr1 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	addr2 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2}
+	routes := func(from net.Addr, to [32]byte, want net.Addr) {
+		t.Helper()
+		_, dst, ok := server.route(from, to)
+		if want == nil && ok {
+			t.Errorf("routed from %v to %v", from, dst)
+		} else if want != nil && (!ok || dst.String() != want.String()) {
+			t.Errorf("routed from %v to %v, want %v", from, dst, want)
+		}
+	}
+
+	// B takes over the address of A, which then registers elsewhere; B
+	// keeps its address.
+	server.register(keyA, addr1)
+	server.register(keyB, addr1)
+	server.register(keyA, addr2)
+	routes(addr1, keyA, addr2)
+	routes(addr2, keyB, addr1)
+
+	// An expired registration is collected without taking the address
+	// of a live one with it.
+	now = now.Add(RegistrationTimeout / 2)
+	server.register(keyB, addr1)
+	now = now.Add(RegistrationTimeout)
+	server.register(keyB, addr1)
+	if server.registered(keyA) {
+		t.Error("expired registration not collected")
+	}
+	routes(addr1, keyB, addr1)
+	routes(addr2, keyB, nil)
+}
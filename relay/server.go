@@ -0,0 +1,188 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+)
+
+type registration struct {
+	addr     net.Addr
+	lastSeen time.Time
+}
+
+// A Server forwards data frames between registered clients. A client can
+// only register under a public key whose private key it holds.
+type Server struct {
+	mu      sync.Mutex
+	byKey   map[[32]byte]*registration
+	byAddr  map[string][32]byte
+	lastGC  time.Time
+	timeNow func() time.Time
+
+	privateKey [32]byte // for challenges, which only last as long as the server
+	publicKey  [32]byte
+	secret     [32]byte // keys the nonces of challenges
+}
+
+func NewServer() (*Server, error) {
+	s := &Server{
+		byKey:   make(map[[32]byte]*registration),
+		byAddr:  make(map[string][32]byte),
+		timeNow: time.Now,
+	}
+	if _, err := rand.Read(s.privateKey[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(s.secret[:]); err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(s.privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(s.publicKey[:], publicKey)
+	return s, nil
+}
+
+// Serve reads frames from pc and forwards them until pc is closed,
+// at which point it returns nil.
+func (s *Server) Serve(pc net.PacketConn) error {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		frameType, key, err := parseHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch frameType {
+		case FrameRegister:
+			if n != RegisterFrameSize {
+				continue
+			}
+			if s.verify(key, addr, buf[FrameHeaderSize:n]) {
+				s.register(key, addr)
+				continue
+			}
+			// The challenge is no larger than the register frame, so that
+			// the server cannot be used to amplify a flood.
+			putHeader(buf, FrameChallenge, &s.publicKey)
+			nonce := s.nonce(key, addr, s.timeNow())
+			copy(buf[FrameHeaderSize:], nonce[:])
+			pc.WriteTo(buf[:ChallengeFrameSize], addr)
+		case FrameData:
+			src, dst, ok := s.route(addr, key)
+			if !ok {
+				continue
+			}
+			putHeader(buf, FrameData, &src)
+			pc.WriteTo(buf[:n], dst)
+		}
+	}
+}
+
+// nonce is the nonce of a challenge to the client registering key from
+// addr. It is valid for one RegistrationTimeout after the one in which it
+// was issued, and from nowhere else, so the server keeps no state for
+// clients until they have proven themselves.
+func (s *Server) nonce(key [32]byte, addr net.Addr, now time.Time) (nonce [NonceSize]byte) {
+	var epoch [8]byte
+	binary.LittleEndian.PutUint64(epoch[:], uint64(now.Unix()/int64(RegistrationTimeout/time.Second)))
+	mac, _ := blake2s.New128(s.secret[:])
+	mac.Write(epoch[:])
+	mac.Write(key[:])
+	mac.Write([]byte(addr.String()))
+	mac.Sum(nonce[:0])
+	return nonce
+}
+
+// verify reports whether payload, that of a register frame for key from
+// addr, answers a current challenge.
+func (s *Server) verify(key [32]byte, addr net.Addr, payload []byte) bool {
+	nonce, proof := payload[:NonceSize], payload[NonceSize:]
+	now := s.timeNow()
+	current, previous := s.nonce(key, addr, now), s.nonce(key, addr, now.Add(-RegistrationTimeout))
+	if !hmac.Equal(nonce, current[:]) && !hmac.Equal(nonce, previous[:]) {
+		return false
+	}
+	shared, err := curve25519.X25519(s.privateKey[:], key[:])
+	if err != nil {
+		return false
+	}
+	want := registerProof(shared, &key, nonce)
+	return hmac.Equal(proof, want[:])
+}
+
+func (s *Server) register(key [32]byte, addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.timeNow()
+	s.gcLocked(now)
+
+	// Only forget the address of an earlier registration while it is
+	// still registered under key.
+	if reg, ok := s.byKey[key]; ok {
+		if old := reg.addr.String(); s.byAddr[old] == key {
+			delete(s.byAddr, old)
+		}
+	}
+	if other, ok := s.byAddr[addr.String()]; ok && other != key {
+		// The client at addr now registers under another key, as when it
+		// rotates its key; the old key is no longer reachable there.
+		delete(s.byKey, other)
+	}
+	s.byKey[key] = &registration{addr: addr, lastSeen: now}
+	s.byAddr[addr.String()] = key
+}
+
+// route finds the public key registered for the sender and the address
+// registered for the destination.
+func (s *Server) route(from net.Addr, to [32]byte) (src [32]byte, dst net.Addr, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.timeNow()
+	src, ok = s.byAddr[from.String()]
+	if !ok || now.Sub(s.byKey[src].lastSeen) > RegistrationTimeout {
+		return src, nil, false
+	}
+	reg := s.byKey[to]
+	if reg == nil || now.Sub(reg.lastSeen) > RegistrationTimeout {
+		return src, nil, false
+	}
+	return src, reg.addr, true
+}
+
+func (s *Server) gcLocked(now time.Time) {
+	if now.Sub(s.lastGC) < RegistrationTimeout {
+		return
+	}
+	s.lastGC = now
+	for key, reg := range s.byKey {
+		if now.Sub(reg.lastSeen) > RegistrationTimeout {
+			if addr := reg.addr.String(); s.byAddr[addr] == key {
+				delete(s.byAddr, addr)
+			}
+			delete(s.byKey, key)
+		}
+	}
+}
@@ -32,10 +32,34 @@ func Now() Timestamp {
 	return stamp(time.Now())
 }
 
+// FromTime returns the timestamp of t, with the same precision as Now.
+func FromTime(t time.Time) Timestamp {
+	return stamp(t)
+}
+
 func (t1 Timestamp) After(t2 Timestamp) bool {
 	return bytes.Compare(t1[:], t2[:]) > 0
 }
 
+// Next returns the earliest timestamp after t with the precision of Now.
+func (t Timestamp) Next() Timestamp {
+	secs := binary.BigEndian.Uint64(t[:8])
+	nano := binary.BigEndian.Uint32(t[8:12])&^whitenerMask + whitenerMask + 1
+	if nano >= uint32(time.Second) {
+		secs++
+		nano = 0
+	}
+	var next Timestamp
+	binary.BigEndian.PutUint64(next[:], secs)
+	binary.BigEndian.PutUint32(next[8:], nano)
+	return next
+}
+
+// Time returns the time of t.
+func (t Timestamp) Time() time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(t[:8])-base), int64(binary.BigEndian.Uint32(t[8:12])))
+}
+
 func (t Timestamp) String() string {
-	return time.Unix(int64(binary.BigEndian.Uint64(t[:8])-base), int64(binary.BigEndian.Uint32(t[8:12]))).String()
+	return t.Time().String()
 }
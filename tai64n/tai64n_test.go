@@ -38,3 +38,22 @@ func TestMonotonic(t *testing.T) {
 		})
 	}
 }
+
+func TestNext(t *testing.T) {
+	for _, start := range []time.Time{
+		time.Unix(0, 123456789),
+		time.Unix(1700000000, 999999999), // carries into the next second
+	} {
+		ts := stamp(start)
+		next := ts.Next()
+		if !next.After(ts) {
+			t.Errorf("Next of %v = %v, not after it", ts, next)
+		}
+		if next.After(stamp(start.Add(20 * time.Millisecond))) {
+			t.Errorf("Next of %v = %v, skipped a timestamp", ts, next)
+		}
+		if got := stamp(next.Time()); got != next {
+			t.Errorf("timestamp of Time of %v = %v", next, got)
+		}
+	}
+}
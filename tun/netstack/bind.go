@@ -0,0 +1,25 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net"
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// NewBind returns a conn.Bind that sends and receives through a UDP socket
+// of tnet bound to laddr, rather than through the host network. A device
+// using it has its encrypted traffic carried inside the tunnel of the device
+// that tnet belongs to, so devices can be nested to any depth within a
+// single unprivileged process. laddr may be an unspecified address, but its
+// family determines which peers can be reached.
+func NewBind(tnet *Net, laddr netip.Addr) conn.Bind {
+	return conn.NewPacketConnBind(func(port uint16) (net.PacketConn, error) {
+		return tnet.ListenUDPAddrPort(netip.AddrPortFrom(laddr, port))
+	})
+}
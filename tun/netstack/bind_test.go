@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// pipe copies every packet read from src into dst until src is closed.
+func pipe(src, dst tun.Device) {
+	bufs := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	for {
+		n, err := src.Read(bufs, sizes, 0)
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			dst.Write([][]byte{bufs[i][:sizes[i]]}, 0)
+		}
+	}
+}
+
+func TestBindSendReceive(t *testing.T) {
+	addrA, addrB := netip.MustParseAddr("192.168.4.1"), netip.MustParseAddr("192.168.4.2")
+	tunA, tnetA, err := CreateNetTUN([]netip.Addr{addrA}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunA.Close()
+	tunB, tnetB, err := CreateNetTUN([]netip.Addr{addrB}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunB.Close()
+	go pipe(tunA, tunB)
+	go pipe(tunB, tunA)
+
+	a, b := NewBind(tnetA, addrA), NewBind(tnetB, addrB)
+	fnsA, portA, err := a.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	fnsB, portB, err := b.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if portA == 0 || portB == 0 {
+		t.Fatal("actual port not reported")
+	}
+
+	receive := func(fns []conn.ReceiveFunc, batchSize int) ([]byte, conn.Endpoint) {
+		bufs := make([][]byte, batchSize)
+		for i := range bufs {
+			bufs[i] = make([]byte, 1500)
+		}
+		sizes := make([]int, len(bufs))
+		eps := make([]conn.Endpoint, len(bufs))
+		n, err := fns[0](bufs, sizes, eps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("received %d packets, want 1", n)
+		}
+		return bufs[0][:sizes[0]], eps[0]
+	}
+
+	ep, err := a.ParseEndpoint(netip.AddrPortFrom(addrB, portB).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Send([][]byte{[]byte("ping")}, ep); err != nil {
+		t.Fatal(err)
+	}
+	got, src := receive(fnsB, b.BatchSize())
+	if !bytes.Equal(got, []byte("ping")) {
+		t.Errorf("received %q, want %q", got, "ping")
+	}
+	if want := netip.AddrPortFrom(addrA, portA).String(); src.DstToString() != want {
+		t.Errorf("source is %s, want %s", src.DstToString(), want)
+	}
+
+	// Replying to the endpoint the request arrived from must reach a.
+	if err := b.Send([][]byte{[]byte("pong")}, src); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = receive(fnsA, a.BatchSize())
+	if !bytes.Equal(got, []byte("pong")) {
+		t.Errorf("received %q, want %q", got, "pong")
+	}
+}
@@ -0,0 +1,81 @@
+//go:build ignore
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+func main() {
+	// The outer tunnel runs over the host network to the first hop.
+	outerTun, outerNet, err := netstack.CreateNetTUN(
+		[]netip.Addr{netip.MustParseAddr("192.168.4.28")},
+		nil,
+		1420)
+	if err != nil {
+		log.Panic(err)
+	}
+	outer := device.NewDevice(outerTun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelVerbose, "outer: "))
+	err = outer.IpcSet(`private_key=6828fe2b4f1863591ebf8617ba46986599ab874a5bff73f6d1aaa85b8886aca1
+public_key=6f3b2c565d293dfaf1aa54a806f091b0d1772f901586cca745ba58ce6be48766
+allowed_ip=192.168.4.1/32
+endpoint=127.0.0.1:58120
+`)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = outer.Up()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// The inner tunnel runs inside the outer one, to the second hop,
+	// which is reachable at 192.168.4.1 from the first.
+	innerTun, innerNet, err := netstack.CreateNetTUN(
+		[]netip.Addr{netip.MustParseAddr("192.168.5.28")},
+		[]netip.Addr{netip.MustParseAddr("8.8.8.8")},
+		1340)
+	if err != nil {
+		log.Panic(err)
+	}
+	inner := device.NewDevice(innerTun, netstack.NewBind(outerNet, netip.MustParseAddr("192.168.4.28")), device.NewLogger(device.LogLevelVerbose, "inner: "))
+	err = inner.IpcSet(`private_key=d5e48b5ee8eca31d52c53b5c8672495ba407222f083e29c6eed6705a19bc4c1e
+public_key=06e5c76817ee3705f22a925d993ac40f0632c273753638f2ae48faaab5d7f6b7
+allowed_ip=0.0.0.0/0
+endpoint=192.168.4.1:51820
+`)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = inner.Up()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: innerNet.DialContext,
+		},
+	}
+	resp, err := client.Get("http://192.168.5.1/")
+	if err != nil {
+		log.Panic(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Println(string(body))
+}